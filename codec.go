@@ -0,0 +1,182 @@
+package possessions
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Codec serializes the sessions the StorageOverseer keeps in the Storer
+type Codec interface {
+	// Header is the first byte of every session serialized by the codec. It
+	// tells the codecs apart when reading so that a Storer can hold sessions
+	// written by different codecs, it must not be '{', 'z' or 0.
+	Header() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// builtinCodecs can always be read by the StorageOverseer
+var builtinCodecs = []Codec{JSONCodec{}, GobCodec{}, BinaryCodec{}}
+
+// JSONCodec serializes sessions with encoding/json, it is the default Codec
+type JSONCodec struct{}
+
+// Header of sessions serialized with json
+func (JSONCodec) Header() byte { return 'r' }
+
+// Marshal v to json
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal json data into v
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec serializes sessions with encoding/gob
+type GobCodec struct{}
+
+// Header of sessions serialized with gob
+func (GobCodec) Header() byte { return 'g' }
+
+// Marshal v to gob
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Unmarshal gob data into v
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// BinaryCodec serializes sessions into a compact binary form. It only knows
+// how to serialize the StorageOverseer's sessions and can not be used for
+// anything else.
+//
+// The format is the varint encoded creation time, ttl and refresh time
+// followed by the number of values and each key and value prefixed with
+// their length. Every value has a byte in front telling if it is a string,
+// which is stored without json quoting, or json.
+type BinaryCodec struct{}
+
+const (
+	binaryValueString = 0
+	binaryValueJSON   = 1
+)
+
+// Header of sessions serialized with the binary codec
+func (BinaryCodec) Header() byte { return 'b' }
+
+// Marshal a session record
+func (BinaryCodec) Marshal(v interface{}) ([]byte, error) {
+	rec, ok := v.(*record)
+	if !ok {
+		return nil, errors.Errorf("binary codec can not marshal %T", v)
+	}
+
+	var buf bytes.Buffer
+	scratch := make([]byte, binary.MaxVarintLen64)
+	putVarint := func(x int64) {
+		buf.Write(scratch[:binary.PutVarint(scratch, x)])
+	}
+	putBytes := func(b []byte) {
+		buf.Write(scratch[:binary.PutUvarint(scratch, uint64(len(b)))])
+		buf.Write(b)
+	}
+
+	putVarint(rec.Created)
+	putVarint(rec.TTL)
+	putVarint(rec.Refreshed)
+	buf.Write(scratch[:binary.PutUvarint(scratch, uint64(len(rec.Values)))])
+
+	for key, raw := range rec.Values {
+		putBytes([]byte(key))
+
+		var str string
+		if len(raw) != 0 && raw[0] == '"' && json.Unmarshal(raw, &str) == nil {
+			buf.WriteByte(binaryValueString)
+			putBytes([]byte(str))
+		} else {
+			buf.WriteByte(binaryValueJSON)
+			putBytes(raw)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Unmarshal a session record
+func (BinaryCodec) Unmarshal(data []byte, v interface{}) error {
+	rec, ok := v.(*record)
+	if !ok {
+		return errors.Errorf("binary codec can not unmarshal into %T", v)
+	}
+
+	r := bytes.NewReader(data)
+	getBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		return b, err
+	}
+
+	var err error
+	for _, x := range []*int64{&rec.Created, &rec.TTL, &rec.Refreshed} {
+		if *x, err = binary.ReadVarint(r); err != nil {
+			return errors.Wrap(err, "malformed binary session")
+		}
+	}
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return errors.Wrap(err, "malformed binary session")
+	}
+	if n > uint64(r.Len()) {
+		return errors.New("malformed binary session: too many values")
+	}
+
+	rec.Values = make(map[string]json.RawMessage, n)
+	for i := uint64(0); i < n; i++ {
+		key, err := getBytes()
+		if err != nil {
+			return errors.Wrap(err, "malformed binary session")
+		}
+		kind, err := r.ReadByte()
+		if err != nil {
+			return errors.Wrap(err, "malformed binary session")
+		}
+		value, err := getBytes()
+		if err != nil {
+			return errors.Wrap(err, "malformed binary session")
+		}
+
+		switch kind {
+		case binaryValueString:
+			rec.Values[string(key)] = rawString(string(value))
+		case binaryValueJSON:
+			rec.Values[string(key)] = value
+		default:
+			return errors.Errorf("malformed binary session: unknown value kind %d", kind)
+		}
+	}
+
+	return nil
+}
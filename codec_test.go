@@ -0,0 +1,141 @@
+package possessions
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCodecs(t *testing.T) {
+	t.Parallel()
+
+	sessionObj := session{
+		Values: map[string]json.RawMessage{
+			"str":   rawString("hello"),
+			"quote": rawString(`say "hi"`),
+			"num":   json.RawMessage(`3`),
+			"obj":   json.RawMessage(`{"a":[1,2]}`),
+		},
+		created:   time.Unix(1600000000, 0),
+		ttl:       time.Hour,
+		refreshed: time.Unix(1600000100, 0),
+	}
+
+	for _, codec := range []Codec{JSONCodec{}, GobCodec{}, BinaryCodec{}} {
+		encoded, err := encodeRecord(sessionObj, codec)
+		if err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+		if encoded[0] != codec.Header() {
+			t.Errorf("%T: expected header %q, got %q", codec, codec.Header(), encoded[0])
+		}
+
+		// The codec is picked by the header when decoding
+		var decoded session
+		if err = decodeRecord(encoded, &decoded); err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+
+		if len(decoded.Values) != len(sessionObj.Values) {
+			t.Errorf("%T: expected %d values, got %d", codec, len(sessionObj.Values), len(decoded.Values))
+		}
+		for key, val := range sessionObj.Values {
+			if string(decoded.Values[key]) != string(val) {
+				t.Errorf("%T: expected %s to be %s, got %s", codec, key, val, decoded.Values[key])
+			}
+		}
+		if !decoded.created.Equal(sessionObj.created) || decoded.ttl != sessionObj.ttl || !decoded.refreshed.Equal(sessionObj.refreshed) {
+			t.Errorf("%T: expected metadata to round trip, got: %#v", codec, decoded)
+		}
+	}
+}
+
+func TestCodecsMalformed(t *testing.T) {
+	t.Parallel()
+
+	var sessionObj session
+	for _, encoded := range []string{"x{}", "g", "b", "b\x00\x00\x00\x05", "b\x00\x00\x00\x01\x01a\x07\x00"} {
+		if err := decodeRecord(encoded, &sessionObj); err == nil {
+			t.Errorf("expected an error decoding %q", encoded)
+		}
+	}
+
+	if _, err := (BinaryCodec{}).Marshal("not a record"); err == nil {
+		t.Error("expected an error marshalling something other than a record")
+	}
+}
+
+// upperCodec is a custom codec for testing
+type upperCodec struct {
+	JSONCodec
+}
+
+func (upperCodec) Header() byte { return 'U' }
+
+func TestStorageOverseerCodec(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	uuid := "816a1acb-73aa-4a75-bbeb-f371bdad40e8"
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Set(ctx, uuid, `{"key":"value"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStorageOverseer(NewCookieOptions(), m)
+	s.Codec = BinaryCodec{}
+
+	read := func() Session {
+		r := httptest.NewRequest("GET", "http://localhost", nil)
+		r.AddCookie(&http.Cookie{Name: "id", Value: uuid})
+		sess, err := s.ReadState(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sess
+	}
+
+	// Sessions written by another codec are read and rewritten with this one
+	sess := read()
+	if err = s.WriteState(ctx, httptest.NewRecorder(), sess, []Event{{Kind: EventSet, Key: "key2", Val: "value2"}}); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := m.Get(ctx, uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored[0] != 'b' {
+		t.Errorf("expected session to be written by the binary codec, got: %q", stored)
+	}
+
+	sess = read()
+	if val, ok := sess.Get("key"); !ok || val != "value" {
+		t.Errorf("expected key to be value, got: %q", val)
+	}
+	if val, ok := sess.Get("key2"); !ok || val != "value2" {
+		t.Errorf("expected key2 to be value2, got: %q", val)
+	}
+
+	// Custom codecs have to be listed to be read
+	if err = m.Set(ctx, uuid, `U{"values":{"key":"custom"}}`); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: uuid})
+	if _, err = s.ReadState(r); err == nil {
+		t.Error("expected an error reading a session written by an unknown codec")
+	}
+
+	s.Codecs = []Codec{upperCodec{}}
+	sess = read()
+	if val, ok := sess.Get("key"); !ok || val != "custom" {
+		t.Errorf("expected key to be custom, got: %q", val)
+	}
+}
@@ -0,0 +1,60 @@
+package possessions
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// compressedHeader starts stored sessions that were compressed with flate,
+// the rest of the value is the compressed form of what would have been
+// stored otherwise
+const compressedHeader = 'z'
+
+// compress the stored session with flate if it is larger than threshold
+// bytes and compressing actually makes it smaller. A threshold of 0 never
+// compresses.
+func compress(encoded string, threshold int) (string, error) {
+	if threshold <= 0 || len(encoded) <= threshold {
+		return encoded, nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(compressedHeader)
+
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create flate writer")
+	}
+	if _, err = w.Write([]byte(encoded)); err != nil {
+		return "", errors.Wrap(err, "failed to compress session")
+	}
+	if err = w.Close(); err != nil {
+		return "", errors.Wrap(err, "failed to compress session")
+	}
+
+	if buf.Len() >= len(encoded) {
+		return encoded, nil
+	}
+
+	return buf.String(), nil
+}
+
+// decompress the stored session if it was compressed by compress
+func decompress(encoded string) (string, error) {
+	if len(encoded) == 0 || encoded[0] != compressedHeader {
+		return encoded, nil
+	}
+
+	r := flate.NewReader(bytes.NewReader([]byte(encoded[1:])))
+	defer r.Close()
+
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decompress session")
+	}
+
+	return string(decompressed), nil
+}
@@ -0,0 +1,115 @@
+package possessions
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	t.Parallel()
+
+	small := `{"key":"value"}`
+	large := `{"key":"` + strings.Repeat("value", 200) + `"}`
+
+	tests := []struct {
+		Name       string
+		Value      string
+		Threshold  int
+		Compressed bool
+	}{
+		{Name: "Disabled", Value: large},
+		{Name: "Small", Value: small, Threshold: 100},
+		{Name: "Large", Value: large, Threshold: 100, Compressed: true},
+		// Random looking data does not get any smaller
+		{Name: "Incompressible", Value: "r8Xq2LmZ0vTgW5pNcY7hK", Threshold: 10},
+	}
+
+	for _, test := range tests {
+		encoded, err := compress(test.Value, test.Threshold)
+		if err != nil {
+			t.Fatalf("%s: %v", test.Name, err)
+		}
+
+		if compressed := encoded[0] == compressedHeader; compressed != test.Compressed {
+			t.Errorf("%s: expected compressed to be %t", test.Name, test.Compressed)
+		}
+		if test.Compressed && len(encoded) >= len(test.Value) {
+			t.Errorf("%s: expected compressed value to be smaller, got %d bytes", test.Name, len(encoded))
+		}
+
+		decoded, err := decompress(encoded)
+		if err != nil {
+			t.Fatalf("%s: %v", test.Name, err)
+		}
+		if decoded != test.Value {
+			t.Errorf("%s: expected value to round trip, got: %q", test.Name, decoded)
+		}
+	}
+
+	if _, err := decompress("znot flate"); err == nil {
+		t.Error("expected an error decompressing garbage")
+	}
+}
+
+func TestStorageOverseerCompressThreshold(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	uuid := "816a1acb-73aa-4a75-bbeb-f371bdad40e8"
+	big := strings.Repeat("preference,", 200)
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Set(ctx, uuid, `{"key":"value"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStorageOverseer(NewCookieOptions(), m)
+	s.CompressThreshold = 1024
+
+	read := func() Session {
+		r := httptest.NewRequest("GET", "http://localhost", nil)
+		r.AddCookie(&http.Cookie{Name: "id", Value: uuid})
+		sess, err := s.ReadState(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sess
+	}
+
+	// Small and legacy sessions are left alone
+	sess := read()
+	if err = s.WriteState(ctx, httptest.NewRecorder(), sess, []Event{{Kind: EventSet, Key: "key2", Val: "value2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := m.Get(ctx, uuid); stored != `{"key":"value","key2":"value2"}` {
+		t.Errorf("expected small session not to be compressed, got: %q", stored)
+	}
+
+	sess = read()
+	if err = s.WriteState(ctx, httptest.NewRecorder(), sess, []Event{{Kind: EventSet, Key: "big", Val: big}}); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := m.Get(ctx, uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored[0] != compressedHeader || len(stored) > len(big)/2 {
+		t.Errorf("expected large session to be compressed, got %d bytes", len(stored))
+	}
+
+	// Compressed sessions are still read once compression is turned off
+	s.CompressThreshold = 0
+	sess = read()
+	if val, ok := sess.Get("big"); !ok || val != big {
+		t.Error("expected big value to be read")
+	}
+	if val, ok := sess.Get("key"); !ok || val != "value" {
+		t.Errorf("expected key to be value, got: %q", val)
+	}
+}
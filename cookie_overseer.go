@@ -0,0 +1,383 @@
+package possessions
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// cookieKeyIDSize is the length of the key id that prefixes every
+	// encrypted cookie value
+	cookieKeyIDSize = 4
+
+	// defaultCookieChunkSize leaves room for the cookie name and attributes
+	// within the 4096 bytes browsers allow for a single cookie
+	defaultCookieChunkSize = 3800
+	// defaultCookieMaxChunks is the default cap on how many cookies a
+	// session may be split across
+	defaultCookieMaxChunks = 4
+
+	// cookieChunkedPrefix marks the value of the main cookie when the
+	// session has been split across several chunk cookies, it is followed
+	// by the number of chunks. It can never appear in a base64 url encoded
+	// value.
+	cookieChunkedPrefix = "chunked:"
+)
+
+// CookieOverseer stores the entire session client side in a cookie. The
+// session values are encrypted and authenticated with AES-GCM so the client
+// can neither read nor modify them.
+type CookieOverseer struct {
+	// ChunkSize is the maximum length of a single cookie value, larger
+	// sessions are split across the cookies name.0, name.1, ... and the
+	// cookie called name records how many chunks there are. The default
+	// is used when it is 0 or less.
+	ChunkSize int
+	// MaxChunks is the hard cap on the number of chunks, writing a session
+	// that needs more than this fails with an error that can be checked
+	// with IsCookieTooLargeError. The default is used when it is 0 or less.
+	MaxChunks int
+
+	options CookieOptions
+	// keys is the keyring, the first key is used to encrypt and all of them
+	// are used to decrypt
+	keys []cookieKey
+}
+
+type cookieKey struct {
+	id   [cookieKeyIDSize]byte
+	aead cipher.AEAD
+}
+
+// NewCookieOverseer returns a new cookie overseer, the secretKey is used
+// as the AES-256 key to encrypt the session cookie.
+func NewCookieOverseer(opts CookieOptions, secretKey [32]byte) *CookieOverseer {
+	return NewCookieOverseerKeyring(opts, [][32]byte{secretKey})
+}
+
+// NewCookieOverseerKeyring returns a new cookie overseer that supports key
+// rotation. The first key in the keyring is used to encrypt cookies, the
+// rest are only used to decrypt cookies that were encrypted before the
+// key was rotated. Those cookies are re-encrypted with the first key the
+// next time the session state is written.
+func NewCookieOverseerKeyring(opts CookieOptions, keyring [][32]byte) *CookieOverseer {
+	if len(opts.Name) == 0 {
+		panic("cookie name must be provided")
+	}
+	if len(keyring) == 0 {
+		panic("at least one secret key must be provided")
+	}
+
+	keys := make([]cookieKey, len(keyring))
+	for i, secretKey := range keyring {
+		block, err := aes.NewCipher(secretKey[:])
+		if err != nil {
+			panic(errors.Wrap(err, "failed to create aes cipher"))
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			panic(errors.Wrap(err, "failed to create gcm cipher"))
+		}
+
+		keys[i].aead = aead
+		keys[i].id = cookieKeyID(secretKey)
+
+		for j := 0; j < i; j++ {
+			if keys[j].id == keys[i].id {
+				panic("secret keys in the keyring must be unique")
+			}
+		}
+	}
+
+	return &CookieOverseer{
+		ChunkSize: defaultCookieChunkSize,
+		MaxChunks: defaultCookieMaxChunks,
+		options:   opts,
+		keys:      keys,
+	}
+}
+
+// cookieKeyID identifies a key inside the encrypted cookie value without
+// revealing anything useful about the key itself
+func cookieKeyID(secretKey [32]byte) [cookieKeyIDSize]byte {
+	var id [cookieKeyIDSize]byte
+	sum := sha256.Sum256(secretKey[:])
+	copy(id[:], sum[:])
+	return id
+}
+
+// ReadState from the request
+func (c CookieOverseer) ReadState(r *http.Request) (Session, error) {
+	plaintext, stale, chunks, err := c.readPlaintext(r)
+	if err != nil || plaintext == nil {
+		return nil, err
+	}
+
+	sessValues := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(plaintext, &sessValues); err != nil {
+		return nil, errNoSession{}
+	}
+
+	return session{
+		Values: sessValues,
+		stale:  stale,
+		chunks: chunks,
+	}, nil
+}
+
+// WriteState to the response
+func (c CookieOverseer) WriteState(ctx context.Context, w http.ResponseWriter, sess Session, evs []Event) error {
+	if len(evs) == 1 && evs[0].Kind == EventDelClientState {
+		c.deleteClientState(w)
+		return nil
+	}
+
+	sessionObj, oldChunks := c.writableSession(sess, evs)
+	doRefresh, dirty := applyEvents(sessionObj, evs)
+	if c.unchanged(w, sess, evs, doRefresh, dirty) {
+		return nil
+	}
+
+	encodedValues, err := json.Marshal(sessionObj.Values)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal session values to json")
+	}
+
+	value, err := c.encrypt(encodedValues)
+	if err != nil {
+		return err
+	}
+
+	return c.writeCookie(w, value, oldChunks)
+}
+
+// readPlaintext reads and decrypts the cookie value. When the request has
+// no cookie the plaintext and error are both nil.
+func (c CookieOverseer) readPlaintext(r *http.Request) (plaintext []byte, stale bool, chunks int, err error) {
+	val, chunks, err := c.readCookie(r)
+	if err != nil {
+		if IsNoSessionError(err) {
+			return nil, false, 0, nil
+		}
+		// Missing or malformed chunks cannot be put back together
+		return nil, false, 0, errNoSession{}
+	}
+
+	plaintext, stale, err = c.decrypt(val)
+	if err != nil {
+		// A cookie we cannot decrypt has either been tampered with or was
+		// encrypted with a different key, either way it is not a session.
+		return nil, false, 0, errNoSession{}
+	}
+
+	return plaintext, stale, chunks, nil
+}
+
+// deleteClientState deletes the cookie and, since the client state could
+// not be read and we have no idea how many chunks the client holds, every
+// chunk it could have.
+func (c CookieOverseer) deleteClientState(w http.ResponseWriter) {
+	c.options.deleteCookie(w)
+	c.deleteChunks(w, 0, c.maxChunks())
+}
+
+// writableSession returns the session that evs should be applied to and the
+// number of chunk cookies the client currently holds
+func (c CookieOverseer) writableSession(sess Session, evs []Event) (session, int) {
+	if sess != nil {
+		sessionObj := sess.(session)
+		return sessionObj, sessionObj.chunks
+	}
+
+	sessionObj := session{
+		Values: make(map[string]json.RawMessage),
+	}
+
+	// The client state could not be read, it may have left chunks behind
+	if hasEvent(evs, EventDelClientState) {
+		return sessionObj, c.maxChunks()
+	}
+
+	return sessionObj, 0
+}
+
+// unchanged returns true when the cookie the client holds is already up to
+// date, so nothing needs to be written. Anonymous visitors only get a cookie
+// once something is stored in their session, and cookies that are being
+// regenerated or that were encrypted with a key that has since been rotated
+// out are always rewritten.
+func (c CookieOverseer) unchanged(w http.ResponseWriter, sess Session, evs []Event, doRefresh, dirty bool) bool {
+	if dirty {
+		return false
+	}
+
+	if sess == nil {
+		if hasEvent(evs, EventDelClientState) {
+			c.deleteClientState(w)
+		}
+		return true
+	}
+
+	return !doRefresh && !sess.(session).stale && !hasEvent(evs, EventRegenerate)
+}
+
+// readCookie returns the encrypted cookie value reassembled from its
+// chunks along with the number of chunks it was split across.
+func (c CookieOverseer) readCookie(r *http.Request) (value string, chunks int, err error) {
+	value, err = c.options.getCookieValue(r)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if !strings.HasPrefix(value, cookieChunkedPrefix) {
+		return value, 0, nil
+	}
+
+	chunks, err = strconv.Atoi(value[len(cookieChunkedPrefix):])
+	if err != nil || chunks < 1 || chunks > c.maxChunks() {
+		return "", 0, errors.Errorf("invalid cookie chunk count: %q", value)
+	}
+
+	var b strings.Builder
+	for i := 0; i < chunks; i++ {
+		chunk, err := r.Cookie(c.chunkOptions(i).Name)
+		if err != nil {
+			return "", 0, errors.Errorf("cookie chunk %d is missing", i)
+		}
+		b.WriteString(chunk.Value)
+	}
+
+	return b.String(), chunks, nil
+}
+
+// writeCookie sets the encrypted value on the response, splitting it across
+// chunk cookies if it's larger than ChunkSize. oldChunks is the number of
+// chunks the client currently holds so the ones no longer needed can be
+// deleted.
+func (c CookieOverseer) writeCookie(w http.ResponseWriter, value string, oldChunks int) error {
+	chunkSize, maxChunks := c.chunkSize(), c.maxChunks()
+	if len(value) <= chunkSize {
+		http.SetCookie(w, c.options.makeCookie(value))
+		c.deleteChunks(w, 0, oldChunks)
+		return nil
+	}
+
+	chunks := (len(value) + chunkSize - 1) / chunkSize
+	if chunks > maxChunks {
+		return errCookieTooLarge{size: len(value), max: chunkSize * maxChunks}
+	}
+
+	http.SetCookie(w, c.options.makeCookie(cookieChunkedPrefix+strconv.Itoa(chunks)))
+	for i := 0; i < chunks; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		http.SetCookie(w, c.chunkOptions(i).makeCookie(value[i*chunkSize:end]))
+	}
+	c.deleteChunks(w, chunks, oldChunks)
+
+	return nil
+}
+
+// chunkSize returns ChunkSize or the default when it is not set
+func (c CookieOverseer) chunkSize() int {
+	if c.ChunkSize <= 0 {
+		return defaultCookieChunkSize
+	}
+
+	return c.ChunkSize
+}
+
+// maxChunks returns MaxChunks or the default when it is not set
+func (c CookieOverseer) maxChunks() int {
+	if c.MaxChunks <= 0 {
+		return defaultCookieMaxChunks
+	}
+
+	return c.MaxChunks
+}
+
+// deleteChunks deletes the chunk cookies in the range [from, to)
+func (c CookieOverseer) deleteChunks(w http.ResponseWriter, from, to int) {
+	for i := from; i < to; i++ {
+		c.chunkOptions(i).deleteCookie(w)
+	}
+}
+
+// chunkOptions returns the cookie options for the nth chunk cookie
+func (c CookieOverseer) chunkOptions(n int) CookieOptions {
+	opts := c.options
+	opts.Name = fmt.Sprintf("%s.%d", c.options.Name, n)
+	return opts
+}
+
+// encrypt seals the plaintext with the first key in the keyring and
+// returns it base64 encoded in the form: keyid|nonce|ciphertext. The cookie
+// name is used as additional data so a value cannot be moved between
+// differently named cookies.
+func (c CookieOverseer) encrypt(plaintext []byte) (string, error) {
+	key := c.keys[0]
+
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", errors.Wrap(err, "failed to generate nonce")
+	}
+
+	sealed := make([]byte, 0, cookieKeyIDSize+len(nonce)+len(plaintext)+key.aead.Overhead())
+	sealed = append(sealed, key.id[:]...)
+	sealed = append(sealed, nonce...)
+	sealed = key.aead.Seal(sealed, nonce, plaintext, []byte(c.options.Name))
+
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt reverses encrypt, stale is true when the value was encrypted with
+// a key other than the first key in the keyring.
+func (c CookieOverseer) decrypt(value string) (plaintext []byte, stale bool, err error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to decode cookie value")
+	}
+
+	if len(sealed) < cookieKeyIDSize {
+		return nil, false, errors.New("encrypted cookie value is too short")
+	}
+
+	var id [cookieKeyIDSize]byte
+	copy(id[:], sealed)
+	sealed = sealed[cookieKeyIDSize:]
+
+	for i, key := range c.keys {
+		if key.id != id {
+			continue
+		}
+
+		nonceSize := key.aead.NonceSize()
+		if len(sealed) < nonceSize {
+			return nil, false, errors.New("encrypted cookie value is too short")
+		}
+
+		plaintext, err = key.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(c.options.Name))
+		if err != nil {
+			return nil, false, errors.Wrap(err, "failed to decrypt cookie value")
+		}
+
+		return plaintext, i != 0, nil
+	}
+
+	return nil, false, errors.New("cookie value was encrypted with an unknown key")
+}
@@ -0,0 +1,396 @@
+package possessions
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Do assign to nothing to check if implementation of CookieOverseer is complete
+var _ Overseer = CookieOverseer{}
+
+var testCookieKey = [32]byte{
+	1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+	17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32,
+}
+
+func TestCookieOverseerNew(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	if c.options.Name != "id" {
+		t.Error("expected cookie name to be id")
+	}
+	if len(c.keys) != 1 || c.keys[0].aead == nil {
+		t.Error("expected aead cipher to be created")
+	}
+}
+
+func TestCookieOverseerEncryptDecrypt(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+
+	value, err := c.encrypt([]byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, stale, err := c.decrypt(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "hello world" {
+		t.Errorf("expected %q, got %q", "hello world", plaintext)
+	}
+	if stale {
+		t.Error("expected value encrypted with the current key not to be stale")
+	}
+
+	otherKey := testCookieKey
+	otherKey[0] = 0
+	other := NewCookieOverseer(NewCookieOptions(), otherKey)
+	if _, _, err = other.decrypt(value); err == nil {
+		t.Error("expected decryption with a different key to fail")
+	}
+
+	opts := NewCookieOptions()
+	opts.Name = "other"
+	other = NewCookieOverseer(opts, testCookieKey)
+	if _, _, err = other.decrypt(value); err == nil {
+		t.Error("expected decryption with a different cookie name to fail")
+	}
+}
+
+func TestCookieOverseerKeyRotation(t *testing.T) {
+	t.Parallel()
+
+	newKey := testCookieKey
+	newKey[31] = 0
+
+	old := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	rotated := NewCookieOverseerKeyring(NewCookieOptions(), [][32]byte{newKey, testCookieKey})
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	rec := httptest.NewRecorder()
+	err := old.WriteState(r.Context(), rec, nil, []Event{{Kind: EventSet, Key: "key", Val: "value"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(rec.Result().Cookies()[0])
+	sess, err := rotated.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := sess.Get("key"); !ok || val != "value" {
+		t.Errorf("expected key to be value, got: %q", val)
+	}
+	if !sess.(session).stale {
+		t.Error("expected session encrypted with the old key to be stale")
+	}
+
+	// Even without any events the cookie must be re-encrypted
+	rec = httptest.NewRecorder()
+	if err = rotated.WriteState(r.Context(), rec, sess, nil); err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie, got %d", len(cookies))
+	}
+
+	_, stale, err := rotated.decrypt(cookies[0].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale {
+		t.Error("expected re-encrypted cookie to use the first key")
+	}
+	if _, _, err = old.decrypt(cookies[0].Value); err == nil {
+		t.Error("expected the old keyring to be unable to read the new cookie")
+	}
+}
+
+func TestCookieOverseerReadWriteState(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	sess, err := c.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess != nil {
+		t.Error("expected no session without a cookie")
+	}
+
+	rec := httptest.NewRecorder()
+	err = c.WriteState(r.Context(), rec, sess, []Event{
+		{Kind: EventSet, Key: "key1", Val: "value1"},
+		{Kind: EventSet, Key: "key2", Val: "value2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie, got %d", len(cookies))
+	}
+	if cookies[0].Value == "" {
+		t.Error("expected cookie value to be set")
+	}
+
+	r = httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(cookies[0])
+	sess, err = c.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := sess.Get("key1"); !ok || val != "value1" {
+		t.Errorf("expected key1 to be value1, got: %q", val)
+	}
+
+	rec = httptest.NewRecorder()
+	err = c.WriteState(r.Context(), rec, sess, []Event{
+		{Kind: EventDel, Key: "key1"},
+		{Kind: EventRefresh},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(rec.Result().Cookies()[0])
+	sess, err = c.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sess.Get("key1"); ok {
+		t.Error("expected key1 to be deleted")
+	}
+	if val, ok := sess.Get("key2"); !ok || val != "value2" {
+		t.Errorf("expected key2 to be value2, got: %q", val)
+	}
+}
+
+func TestCookieOverseerReadStateTampered(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: "816a1acb-73aa-4a75-bbeb-f371bdad40e8"})
+
+	_, err := c.ReadState(r)
+	if !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+}
+
+func TestCookieOverseerWriteStateNoEvents(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	rec := httptest.NewRecorder()
+
+	sess := session{Values: map[string]json.RawMessage{"key": rawString("value")}}
+	if err := c.WriteState(r.Context(), rec, sess, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Header().Get("Set-Cookie") != "" {
+		t.Error("expected no cookie to be written for an unchanged session")
+	}
+}
+
+func TestCookieOverseerDelClientState(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	rec := httptest.NewRecorder()
+
+	err := c.WriteState(r.Context(), rec, nil, []Event{{Kind: EventDelClientState}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1+c.MaxChunks {
+		t.Fatalf("expected the cookie and every chunk to be deleted, got %d cookies", len(cookies))
+	}
+	for _, cookie := range cookies {
+		if cookie.MaxAge != -1 || cookie.Value != "" {
+			t.Errorf("expected cookie to be deleted, got: %#v", cookie)
+		}
+	}
+}
+
+// requestWithCookies carries the cookies set on a response over to a new
+// request the way a browser would
+func requestWithCookies(rec *httptest.ResponseRecorder, prev *http.Request) *http.Request {
+	jar := make(map[string]*http.Cookie)
+	if prev != nil {
+		for _, c := range prev.Cookies() {
+			jar[c.Name] = c
+		}
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(jar, c.Name)
+			continue
+		}
+		jar[c.Name] = c
+	}
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	for _, c := range jar {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestCookieOverseerChunks(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	c.ChunkSize = 100
+
+	big := strings.Repeat("a", 250)
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	rec := httptest.NewRecorder()
+	err := c.WriteState(r.Context(), rec, nil, []Event{{Kind: EventSet, Key: "big", Val: big}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = requestWithCookies(rec, nil)
+	if cookie, err := r.Cookie("id"); err != nil || cookie.Value != "chunked:4" {
+		t.Errorf("expected main cookie to hold the chunk count, got: %v", cookie)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := r.Cookie(fmt.Sprintf("id.%d", i)); err != nil {
+			t.Errorf("expected chunk %d to be set", i)
+		}
+	}
+
+	sess, err := c.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := sess.Get("big"); !ok || val != big {
+		t.Errorf("expected reassembled value, got: %q", val)
+	}
+	if sess.(session).chunks != 4 {
+		t.Errorf("expected 4 chunks, got %d", sess.(session).chunks)
+	}
+
+	// Shrinking the session must delete the chunks that are no longer used
+	rec = httptest.NewRecorder()
+	err = c.WriteState(r.Context(), rec, sess, []Event{{Kind: EventSet, Key: "big", Val: "small"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = requestWithCookies(rec, r)
+	for i := 0; i < 4; i++ {
+		if _, err := r.Cookie(fmt.Sprintf("id.%d", i)); err == nil {
+			t.Errorf("expected chunk %d to be deleted", i)
+		}
+	}
+
+	sess, err = c.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := sess.Get("big"); !ok || val != "small" {
+		t.Errorf("expected small value, got: %q", val)
+	}
+}
+
+func TestCookieOverseerChunksDefaults(t *testing.T) {
+	t.Parallel()
+
+	for _, size := range []int{0, -1} {
+		c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+		c.ChunkSize = size
+		c.MaxChunks = size
+
+		// Split across the default chunk size
+		big := strings.Repeat("a", defaultCookieChunkSize)
+
+		r := httptest.NewRequest("GET", "http://localhost", nil)
+		rec := httptest.NewRecorder()
+		err := c.WriteState(r.Context(), rec, nil, []Event{{Kind: EventSet, Key: "big", Val: big}})
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+
+		r = requestWithCookies(rec, nil)
+		sess, err := c.ReadState(r)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if val, ok := sess.Get("big"); !ok || val != big {
+			t.Errorf("size %d: expected reassembled value, got %d bytes", size, len(val))
+		}
+		if sess.(session).chunks < 2 {
+			t.Errorf("size %d: expected the value to be chunked, got %d chunks", size, sess.(session).chunks)
+		}
+
+		// Capped at the default number of chunks
+		huge := strings.Repeat("a", defaultCookieChunkSize*defaultCookieMaxChunks)
+		rec = httptest.NewRecorder()
+		err = c.WriteState(r.Context(), rec, nil, []Event{{Kind: EventSet, Key: "huge", Val: huge}})
+		if !IsCookieTooLargeError(err) {
+			t.Errorf("size %d: expected cookie too large error, got: %v", size, err)
+		}
+	}
+}
+
+func TestCookieOverseerChunksMissing(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: "chunked:2"})
+	r.AddCookie(&http.Cookie{Name: "id.0", Value: "abc"})
+
+	if _, err := c.ReadState(r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+
+	r = httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: "chunked:100"})
+
+	if _, err := c.ReadState(r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+}
+
+func TestCookieOverseerTooLarge(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	c.ChunkSize = 100
+	c.MaxChunks = 2
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	rec := httptest.NewRecorder()
+	err := c.WriteState(r.Context(), rec, nil, []Event{{Kind: EventSet, Key: "big", Val: strings.Repeat("a", 250)}})
+	if !IsCookieTooLargeError(err) {
+		t.Errorf("expected cookie too large error, got: %v", err)
+	}
+	if rec.Header().Get("Set-Cookie") != "" {
+		t.Error("expected no cookies to be written")
+	}
+}
@@ -2,6 +2,8 @@ package possessions
 
 import (
 	"context"
+	"encoding/binary"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -12,6 +14,16 @@ import (
 	"github.com/pkg/errors"
 )
 
+const (
+	// diskTTLHeader is the first byte of session files saved with a ttl,
+	// it is followed by the ttl in nanoseconds (8 bytes, big endian) and
+	// then the value
+	diskTTLHeader = 0
+	// diskTTLHeaderSize is the size of the header of a session file saved
+	// with a ttl
+	diskTTLHeaderSize = 9
+)
+
 // DiskStorer is a session storer implementation for saving sessions
 // to disk.
 type DiskStorer struct {
@@ -24,6 +36,9 @@ type DiskStorer struct {
 	cleanInterval time.Duration
 	// Disk storage mutex
 	mut sync.RWMutex
+	// locks holds the session locks handed out by Lock on platforms
+	// without flock
+	locks keyMutex
 	// wg is used to manage the cleaner loop
 	wg sync.WaitGroup
 	// quit channel for exiting the cleaner loop
@@ -88,7 +103,7 @@ func (d *DiskStorer) All(ctx context.Context) ([]string, error) {
 // Get returns the value string saved in the session pointed to by the
 // session id key.
 func (d *DiskStorer) Get(ctx context.Context, key string) (value string, err error) {
-	if !validKey(key) {
+	if !validFileKey(key) {
 		return "", errNoSession{}
 	}
 
@@ -107,12 +122,13 @@ func (d *DiskStorer) Get(ctx context.Context, key string) (value string, err err
 		return "", errors.Wrapf(err, "unable to read file: %s", filePath)
 	}
 
-	return string(contents), nil
+	value, _ = decodeDiskFile(contents)
+	return value, nil
 }
 
 // Set saves the value string to the session pointed to by the session id key.
 func (d *DiskStorer) Set(ctx context.Context, key, value string) error {
-	if !validKey(key) {
+	if !validFileKey(key) {
 		return errNoSession{}
 	}
 
@@ -124,9 +140,66 @@ func (d *DiskStorer) Set(ctx context.Context, key, value string) error {
 	return ioutil.WriteFile(filePath, []byte(value), 0600)
 }
 
+// SetWithTTL saves the value string to the session pointed to by the session
+// id key so that it expires after ttl instead of maxAge. The ttl is kept in
+// the session file, see ResetExpiryTTL.
+func (d *DiskStorer) SetWithTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+	if !validFileKey(key) {
+		return errNoSession{}
+	}
+	if ttl == 0 {
+		return errors.New("disk session ttl must not be 0")
+	}
+
+	filePath := path.Join(d.folderPath, key)
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	return ioutil.WriteFile(filePath, encodeDiskFile(value, ttl), 0600)
+}
+
+// GetVersion returns the value string saved in the session pointed to by the
+// session id key and its version.
+func (d *DiskStorer) GetVersion(ctx context.Context, key string) (value, version string, err error) {
+	value, err = d.Get(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	return value, valueVersion(value), nil
+}
+
+// CompareAndSet saves the value string to the session pointed to by the
+// session id key if its version still matches. The comparison is only atomic
+// within this process, not between processes sharing the folder.
+func (d *DiskStorer) CompareAndSet(ctx context.Context, key, value, version string) error {
+	if !validFileKey(key) {
+		return errNoSession{}
+	}
+
+	filePath := path.Join(d.folderPath, key)
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	contents, err := ioutil.ReadFile(filePath)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "unable to read file: %s", filePath)
+	}
+
+	current, _ := decodeDiskFile(contents)
+	if exists != (len(version) != 0) || (exists && valueVersion(current) != version) {
+		return errVersionConflict{}
+	}
+
+	return ioutil.WriteFile(filePath, []byte(value), 0600)
+}
+
 // Del the session pointed to by the session id key and remove it.
 func (d *DiskStorer) Del(ctx context.Context, key string) error {
-	if !validKey(key) {
+	if !validFileKey(key) {
 		return errNoSession{}
 	}
 
@@ -145,15 +218,34 @@ func (d *DiskStorer) Del(ctx context.Context, key string) error {
 	return os.Remove(filePath)
 }
 
+// validFileKey returns true if the session key is safe to use as a file
+// name: it is made up of a-z A-Z 0-9 - _ and . but does not start with a .
+func validFileKey(key string) bool {
+	if len(key) == 0 || len(key) > 255 || key[0] == '.' {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') &&
+			c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+
+	return true
+}
+
 // StopCleaner stops the cleaner go routine
 func (d *DiskStorer) StopCleaner() {
 	close(d.quit)
 	d.wg.Wait()
 }
 
-// ResetExpiry resets the expiry of the key
+// ResetExpiry resets the expiry of the key, a session saved with a ttl keeps
+// it
 func (d *DiskStorer) ResetExpiry(ctx context.Context, key string) error {
-	if !validKey(key) {
+	if !validFileKey(key) {
 		return errNoSession{}
 	}
 
@@ -163,6 +255,79 @@ func (d *DiskStorer) ResetExpiry(ctx context.Context, key string) error {
 	return os.Chtimes(filePath, nowTime, nowTime)
 }
 
+// ResetExpiryTTL resets the expiry of the key to ttl from now. Like maxAge
+// the ttl counts from the access time of the session file, the ttl itself is
+// kept in a header at the start of the file so that it survives ResetExpiry
+// and anything else touching the file.
+func (d *DiskStorer) ResetExpiryTTL(ctx context.Context, key string, ttl time.Duration) error {
+	if !validFileKey(key) {
+		return errNoSession{}
+	}
+	if ttl == 0 {
+		return errors.New("disk session ttl must not be 0")
+	}
+
+	filePath := path.Join(d.folderPath, key)
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	contents, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return errNoSession{}
+	} else if err != nil {
+		return errors.Wrapf(err, "unable to read file: %s", filePath)
+	}
+
+	value, _ := decodeDiskFile(contents)
+	if err = ioutil.WriteFile(filePath, encodeDiskFile(value, ttl), 0600); err != nil {
+		return errors.Wrapf(err, "unable to write file: %s", filePath)
+	}
+
+	nowTime := time.Now().UTC()
+	return os.Chtimes(filePath, nowTime, nowTime)
+}
+
+// encodeDiskFile returns the contents of a session file saved with a ttl
+func encodeDiskFile(value string, ttl time.Duration) []byte {
+	contents := make([]byte, diskTTLHeaderSize+len(value))
+	contents[0] = diskTTLHeader
+	binary.BigEndian.PutUint64(contents[1:], uint64(ttl))
+	copy(contents[diskTTLHeaderSize:], value)
+
+	return contents
+}
+
+// decodeDiskFile returns the value of a session file and the ttl it was
+// saved with, 0 if it was saved without one
+func decodeDiskFile(contents []byte) (value string, ttl time.Duration) {
+	if len(contents) < diskTTLHeaderSize || contents[0] != diskTTLHeader {
+		return string(contents), 0
+	}
+
+	ttl = time.Duration(binary.BigEndian.Uint64(contents[1:]))
+	return string(contents[diskTTLHeaderSize:]), ttl
+}
+
+// fileTTL returns how long after its last access the session file expires
+func (d *DiskStorer) fileTTL(filePath string) time.Duration {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return d.maxAge
+	}
+	defer file.Close()
+
+	header := make([]byte, diskTTLHeaderSize)
+	if _, err = io.ReadFull(file, header); err != nil {
+		return d.maxAge
+	}
+	if _, ttl := decodeDiskFile(header); ttl != 0 {
+		return ttl
+	}
+
+	return d.maxAge
+}
+
 // StartCleaner starts the disk session cleaner go routine. This go routine
 // will delete expired disk sessions on the cleanInterval interval.
 func (d *DiskStorer) StartCleaner() {
@@ -198,8 +363,8 @@ func (d *DiskStorer) cleanerLoop() {
 }
 
 // Clean checks all session files on disk to see if they are older than
-// maxAge by checking their access time. If it finds an expired session file
-// it will remove it from disk.
+// maxAge (or the ttl they were saved with) by checking their access time.
+// If it finds an expired session file it will remove it from disk.
 func (d *DiskStorer) Clean() {
 	t := time.Now().UTC()
 
@@ -212,9 +377,10 @@ func (d *DiskStorer) Clean() {
 	for _, file := range files {
 		tspec := times.Get(file)
 
+		filePath := path.Join(d.folderPath, file.Name())
+
 		// File is expired
-		if tspec.AccessTime().UTC().UTC().Add(d.maxAge).Before(t) {
-			filePath := path.Join(d.folderPath, file.Name())
+		if tspec.AccessTime().UTC().Add(d.fileTTL(filePath)).Before(t) {
 
 			d.mut.Lock()
 			_, err := os.Stat(filePath)
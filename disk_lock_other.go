@@ -0,0 +1,25 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package possessions
+
+import (
+	"context"
+	"os"
+	"path"
+)
+
+// Lock the session pointed to by the session id key. flock is not available
+// on this platform so the lock is only held within this process. Sessions
+// that do not exist can not be locked and return errNoSession.
+func (d *DiskStorer) Lock(ctx context.Context, key string) (func(), error) {
+	if !validFileKey(key) {
+		return nil, errNoSession{}
+	}
+
+	if _, err := os.Stat(path.Join(d.folderPath, key)); os.IsNotExist(err) {
+		return nil, errNoSession{}
+	}
+
+	return d.locks.Lock(ctx, key)
+}
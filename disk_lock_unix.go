@@ -0,0 +1,48 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package possessions
+
+import (
+	"context"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Lock the session pointed to by the session id key by taking an exclusive
+// flock on the session file, so the lock is also held against other
+// processes sharing the folder. Sessions that do not exist can not be
+// locked and return errNoSession.
+func (d *DiskStorer) Lock(ctx context.Context, key string) (func(), error) {
+	if !validFileKey(key) {
+		return nil, errNoSession{}
+	}
+
+	filePath := path.Join(d.folderPath, key)
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, errNoSession{}
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "unable to open session file: %s", filePath)
+	}
+
+	err = pollLock(ctx, func() (bool, error) {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == syscall.EWOULDBLOCK || err == syscall.EINTR {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "unable to lock session file: %s", filePath)
+	}
+
+	return func() {
+		// Closing the file releases the lock
+		file.Close()
+	}, nil
+}
@@ -362,3 +362,194 @@ func TestDiskStorerResetExpiry(t *testing.T) {
 		t.Errorf("Expected newexpires to be newer than old expires, got: %#v, %#v", oldExpires, newExpires)
 	}
 }
+
+func TestDiskStorerValidFileKey(t *testing.T) {
+	t.Parallel()
+
+	valid := []string{
+		"816a1acb-73aa-4a75-bbeb-f371bdad40e8",
+		"01ARZ3NDEKTSV4RRFFQ69G5FAV",
+		"Qh2kX_x-mN0yCw7BfW1aHkD9Zr8uTn3sLpEoVj6gGcI",
+		"shard3.abcdef",
+	}
+	for _, key := range valid {
+		if !validFileKey(key) {
+			t.Errorf("expected %q to be valid", key)
+		}
+	}
+
+	invalid := []string{"", ".", "..", "../passwd", "a/b", `a\b`, ".hidden", "a b"}
+	for _, key := range invalid {
+		if validFileKey(key) {
+			t.Errorf("expected %q to be invalid", key)
+		}
+	}
+}
+
+func TestDiskStorerCompareAndSet(t *testing.T) {
+	t.Parallel()
+
+	d, err := NewDiskStorer(filepath.Join(testpath, "h"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	testid1 := uuid.NewV4().String()
+
+	if _, _, err = d.GetVersion(ctx, testid1); !IsNoSessionError(err) {
+		t.Errorf("expected ErrNoSession, got: %v", err)
+	}
+	if err = d.CompareAndSet(ctx, testid1, "hello", "nope"); !IsVersionConflictError(err) {
+		t.Errorf("expected version conflict for missing key, got: %v", err)
+	}
+	if err = d.CompareAndSet(ctx, testid1, "hello", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	_, version, err := d.GetVersion(ctx, testid1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = d.Set(ctx, testid1, "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.CompareAndSet(ctx, testid1, "world", version); !IsVersionConflictError(err) {
+		t.Errorf("expected version conflict for changed key, got: %v", err)
+	}
+
+	_, version, err = d.GetVersion(ctx, testid1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.CompareAndSet(ctx, testid1, "world", version); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := d.Get(ctx, testid1); val != "world" {
+		t.Errorf("expected %q, got %q", "world", val)
+	}
+}
+
+func TestDiskStorerLock(t *testing.T) {
+	t.Parallel()
+
+	d, err := NewDiskStorer(filepath.Join(testpath, "i"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	testid1 := uuid.NewV4().String()
+
+	if _, err = d.Lock(ctx, testid1); !IsNoSessionError(err) {
+		t.Errorf("expected ErrNoSession, got: %v", err)
+	}
+
+	if err = d.Set(ctx, testid1, "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := d.Lock(ctx, testid1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err = d.Lock(timeoutCtx, testid1); err == nil {
+		t.Error("expected lock to time out")
+	}
+
+	// The session can still be used while it is locked
+	if err = d.Set(ctx, testid1, "world"); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock()
+	unlock, err = d.Lock(ctx, testid1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
+
+func TestDiskStorerTTL(t *testing.T) {
+	t.Parallel()
+
+	d, err := NewDiskStorer(filepath.Join(testpath, "j"), time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	short := uuid.NewV4().String()
+	long := uuid.NewV4().String()
+	dflt := uuid.NewV4().String()
+
+	if err = d.SetWithTTL(ctx, short, "hello", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.SetWithTTL(ctx, long, "hello", time.Hour*24*30); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Set(ctx, dflt, "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ttl is kept in the file, resetting the expiry without one keeps it
+	if err = d.ResetExpiry(ctx, short); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := d.Get(ctx, long); err != nil || val != "hello" {
+		t.Errorf("expected the value without the ttl, got: %q %v", val, err)
+	}
+	if _, version, err := d.GetVersion(ctx, long); err != nil || version != valueVersion("hello") {
+		t.Errorf("expected the version of the value, got: %q %v", version, err)
+	}
+
+	// Two hours pass without the sessions being accessed, the modification
+	// times (touched by backups etc.) do not matter
+	twoHoursAgo := time.Now().Add(-2 * time.Hour)
+	for _, key := range []string{short, long, dflt} {
+		if err = os.Chtimes(filepath.Join(d.folderPath, key), twoHoursAgo, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d.Clean()
+
+	if _, err = d.Get(ctx, short); !IsNoSessionError(err) {
+		t.Errorf("expected short session to be expired, got: %v", err)
+	}
+	if _, err = d.Get(ctx, dflt); !IsNoSessionError(err) {
+		t.Errorf("expected default session to be expired, got: %v", err)
+	}
+	if val, err := d.Get(ctx, long); err != nil || val != "hello" {
+		t.Errorf("expected long session to be kept, got: %q %v", val, err)
+	}
+
+	if err = d.ResetExpiryTTL(ctx, long, 0); err == nil {
+		t.Error("expected an error for a ttl of 0")
+	}
+
+	// Compare and set replaces the value and goes back to maxAge
+	if err = d.CompareAndSet(ctx, long, "hi", valueVersion("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := d.Get(ctx, long); err != nil || val != "hi" {
+		t.Errorf("expected hi, got: %q %v", val, err)
+	}
+	if ttl := d.fileTTL(filepath.Join(d.folderPath, long)); ttl != d.maxAge {
+		t.Errorf("expected the max age, got: %v", ttl)
+	}
+	if err = d.ResetExpiryTTL(ctx, long, time.Hour*24*30); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := d.fileTTL(filepath.Join(d.folderPath, long)); ttl != time.Hour*24*30 {
+		t.Errorf("expected the ttl to be stored, got: %v", ttl)
+	}
+	if err = d.ResetExpiryTTL(ctx, uuid.NewV4().String(), time.Hour); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/volatiletech/possessions
 
-go 1.14
+go 1.18
 
 require (
 	github.com/djherbis/times v1.2.0
@@ -9,3 +9,8 @@ require (
 	github.com/pkg/errors v0.9.1
 	github.com/satori/go.uuid v1.2.0
 )
+
+require (
+	go.opentelemetry.io/otel v0.2.4-0.20200313034849-fcc4aca8c78d // indirect
+	google.golang.org/grpc v1.27.1 // indirect
+)
@@ -0,0 +1,188 @@
+package possessions
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultHybridThreshold keeps sessions that fit comfortably into a
+	// single encrypted cookie client side
+	defaultHybridThreshold = 2048
+
+	// hybridModeValues prefixes cookie plaintext that holds the session values
+	hybridModeValues = 'v'
+	// hybridModeID prefixes cookie plaintext that holds a Storer session id
+	hybridModeID = 'i'
+)
+
+// HybridOverseer keeps small sessions entirely client side in an encrypted
+// cookie like the CookieOverseer. Once the encoded session values grow past
+// Threshold they are moved into the Storer and only the session id is kept
+// in the (still encrypted) cookie like the StorageOverseer. Sessions move
+// back into the cookie when they shrink again.
+type HybridOverseer struct {
+	// Threshold is the size in bytes of the json encoded session values
+	// above which the session is kept in the Storer
+	Threshold int
+	Storer    Storer
+	// IDGenerator creates the IDs of sessions kept in the Storer, it
+	// defaults to UUIDGenerator.
+	IDGenerator IDGenerator
+
+	cookie *CookieOverseer
+}
+
+// NewHybridOverseer returns a new hybrid overseer. The keyring is used to
+// encrypt the cookie in the same way as NewCookieOverseerKeyring.
+func NewHybridOverseer(opts CookieOptions, keyring [][32]byte, storer Storer) *HybridOverseer {
+	return &HybridOverseer{
+		Threshold:   defaultHybridThreshold,
+		Storer:      storer,
+		IDGenerator: UUIDGenerator{},
+		cookie:      NewCookieOverseerKeyring(opts, keyring),
+	}
+}
+
+// ReadState from the request
+func (h HybridOverseer) ReadState(r *http.Request) (Session, error) {
+	plaintext, stale, chunks, err := h.cookie.readPlaintext(r)
+	if err != nil || plaintext == nil {
+		return nil, err
+	}
+
+	if len(plaintext) == 0 {
+		return nil, errNoSession{}
+	}
+
+	sessionObj := session{
+		stale:  stale,
+		chunks: chunks,
+	}
+
+	var encodedSession []byte
+	switch plaintext[0] {
+	case hybridModeValues:
+		encodedSession = plaintext[1:]
+	case hybridModeID:
+		sessionObj.ID = string(plaintext[1:])
+		if !h.IDGenerator.Validate(sessionObj.ID) {
+			return nil, errNoSession{}
+		}
+
+		stored, err := h.Storer.Get(r.Context(), sessionObj.ID)
+		if err != nil {
+			return nil, err
+		}
+		encodedSession = []byte(stored)
+	default:
+		return nil, errNoSession{}
+	}
+
+	sessionObj.Values = make(map[string]json.RawMessage)
+	if err = json.Unmarshal(encodedSession, &sessionObj.Values); err != nil {
+		return nil, errNoSession{}
+	}
+
+	return sessionObj, nil
+}
+
+// WriteState to the response
+func (h HybridOverseer) WriteState(ctx context.Context, w http.ResponseWriter, sess Session, evs []Event) error {
+	if len(evs) == 1 && evs[0].Kind == EventDelClientState {
+		h.cookie.deleteClientState(w)
+		return nil
+	}
+
+	sessionObj, oldChunks := h.cookie.writableSession(sess, evs)
+	doRefresh, dirty := applyEvents(sessionObj, evs)
+	if h.cookie.unchanged(w, sess, evs, doRefresh, dirty) {
+		return nil
+	}
+
+	encodedValues, err := json.Marshal(sessionObj.Values)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal session values to json")
+	}
+
+	if len(encodedValues) > h.Threshold {
+		regenerate := hasEvent(evs, EventRegenerate)
+		return h.writeStorer(ctx, w, sessionObj, encodedValues, oldChunks, doRefresh, dirty, regenerate)
+	}
+
+	plaintext := make([]byte, 0, len(encodedValues)+1)
+	plaintext = append(plaintext, hybridModeValues)
+	plaintext = append(plaintext, encodedValues...)
+
+	value, err := h.cookie.encrypt(plaintext)
+	if err != nil {
+		return err
+	}
+
+	if err = h.cookie.writeCookie(w, value, oldChunks); err != nil {
+		return err
+	}
+
+	// The session has moved into the cookie, the stored copy is garbage now
+	if len(sessionObj.ID) != 0 {
+		if err = h.Storer.Del(ctx, sessionObj.ID); err != nil {
+			return errors.Wrap(err, "failed to delete stored session")
+		}
+	}
+
+	return nil
+}
+
+// writeStorer puts the encoded values into the Storer and the session id
+// into the cookie
+func (h HybridOverseer) writeStorer(ctx context.Context, w http.ResponseWriter, sessionObj session, encodedValues []byte, oldChunks int, doRefresh, dirty, regenerate bool) error {
+	oldID := sessionObj.ID
+	isNew := len(oldID) == 0
+	regenerate = regenerate && !isNew
+
+	if isNew || regenerate {
+		id, err := h.IDGenerator.Generate()
+		if err != nil {
+			return err
+		}
+		sessionObj.ID = id
+	}
+
+	if dirty || isNew || regenerate {
+		err := h.Storer.Set(ctx, sessionObj.ID, string(encodedValues))
+		if err != nil {
+			return errors.Wrap(err, "failed to store session values")
+		}
+	}
+
+	if doRefresh && !isNew {
+		if err := h.Storer.ResetExpiry(ctx, sessionObj.ID); err != nil {
+			return errors.Wrap(err, "failed to refresh session")
+		}
+	}
+
+	if regenerate {
+		if err := h.Storer.Del(ctx, oldID); err != nil {
+			return errors.Wrap(err, "failed to delete regenerated session")
+		}
+	}
+
+	// The cookie already points at this session
+	if !isNew && !regenerate && !doRefresh && !sessionObj.stale {
+		return nil
+	}
+
+	plaintext := make([]byte, 0, len(sessionObj.ID)+1)
+	plaintext = append(plaintext, hybridModeID)
+	plaintext = append(plaintext, sessionObj.ID...)
+
+	value, err := h.cookie.encrypt(plaintext)
+	if err != nil {
+		return err
+	}
+
+	return h.cookie.writeCookie(w, value, oldChunks)
+}
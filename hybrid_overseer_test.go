@@ -0,0 +1,205 @@
+package possessions
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Do assign to nothing to check if implementation of HybridOverseer is complete
+var _ Overseer = HybridOverseer{}
+
+func TestHybridOverseerNew(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHybridOverseer(NewCookieOptions(), [][32]byte{testCookieKey}, m)
+	if h.Threshold != defaultHybridThreshold {
+		t.Errorf("expected threshold to be %d, got %d", defaultHybridThreshold, h.Threshold)
+	}
+	if h.Storer != m {
+		t.Error("expected storer to be set")
+	}
+}
+
+func TestHybridOverseerSwitchModes(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHybridOverseer(NewCookieOptions(), [][32]byte{testCookieKey}, m)
+	h.Threshold = 100
+	ctx := context.Background()
+
+	// Small sessions stay in the cookie
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	rec := httptest.NewRecorder()
+	err = h.WriteState(ctx, rec, nil, []Event{{Kind: EventSet, Key: "key", Val: "value"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := m.All(ctx); len(keys) != 0 {
+		t.Errorf("expected nothing in the storer, got %d keys", len(keys))
+	}
+
+	r = requestWithCookies(rec, r)
+	sess, err := h.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := sess.Get("key"); !ok || val != "value" {
+		t.Errorf("expected key to be value, got: %q", val)
+	}
+	if len(sess.(session).ID) != 0 {
+		t.Error("expected cookie session to have no id")
+	}
+
+	// Large sessions spill into the storer
+	big := strings.Repeat("a", 200)
+	rec = httptest.NewRecorder()
+	err = h.WriteState(ctx, rec, sess, []Event{{Kind: EventSet, Key: "big", Val: big}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := m.All(ctx)
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 key in the storer, got %d", len(keys))
+	}
+
+	r = requestWithCookies(rec, r)
+	cookie, err := r.Cookie("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(cookie.Value, keys[0]) {
+		t.Error("expected session id in the cookie to be encrypted")
+	}
+
+	sess, err = h.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.(session).ID != keys[0] {
+		t.Errorf("expected session id %q, got %q", keys[0], sess.(session).ID)
+	}
+	if val, ok := sess.Get("big"); !ok || val != big {
+		t.Errorf("expected big value, got: %q", val)
+	}
+	if val, ok := sess.Get("key"); !ok || val != "value" {
+		t.Errorf("expected key to be value, got: %q", val)
+	}
+
+	// Regenerating moves the values to a new id
+	rec = httptest.NewRecorder()
+	err = h.WriteState(ctx, rec, sess, []Event{{Kind: EventRegenerate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Get(ctx, keys[0]); !IsNoSessionError(err) {
+		t.Errorf("expected the old session to be deleted, got: %v", err)
+	}
+
+	r = requestWithCookies(rec, r)
+	sess, err = h.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := sess.(session).ID; id == keys[0] || !validKey(id) {
+		t.Errorf("expected a new session id, got: %q", id)
+	}
+	if val, ok := sess.Get("big"); !ok || val != big {
+		t.Errorf("expected big value, got: %q", val)
+	}
+
+	// Updating a stored session leaves the cookie alone
+	rec = httptest.NewRecorder()
+	err = h.WriteState(ctx, rec, sess, []Event{{Kind: EventSet, Key: "key", Val: "value2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Header().Get("Set-Cookie") != "" {
+		t.Error("expected no cookie to be written")
+	}
+
+	// Shrinking moves it back into the cookie and cleans up the storer
+	rec = httptest.NewRecorder()
+	err = h.WriteState(ctx, rec, sess, []Event{{Kind: EventDel, Key: "big"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := m.All(ctx); len(keys) != 0 {
+		t.Errorf("expected stored session to be deleted, got %d keys", len(keys))
+	}
+
+	r = requestWithCookies(rec, r)
+	sess, err = h.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sess.Get("big"); ok {
+		t.Error("expected big to be deleted")
+	}
+	if val, ok := sess.Get("key"); !ok || val != "value2" {
+		t.Errorf("expected key to be value2, got: %q", val)
+	}
+}
+
+func TestHybridOverseerReadStateMissing(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHybridOverseer(NewCookieOptions(), [][32]byte{testCookieKey}, m)
+
+	value, err := h.cookie.encrypt([]byte("i816a1acb-73aa-4a75-bbeb-f371bdad40e8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: value})
+
+	if _, err = h.ReadState(r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+}
+
+func TestHybridOverseerReadStateMalformed(t *testing.T) {
+	t.Parallel()
+
+	uuid := "816a1acb-73aa-4a75-bbeb-f371bdad40e8"
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Set(context.Background(), uuid, "not json"); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHybridOverseer(NewCookieOptions(), [][32]byte{testCookieKey}, m)
+
+	value, err := h.cookie.encrypt([]byte("i" + uuid))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: value})
+
+	if _, err = h.ReadState(r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+}
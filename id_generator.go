@@ -0,0 +1,88 @@
+package possessions
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultRandomIDSize is the number of random bytes used when
+	// RandomIDGenerator.Size is not set
+	defaultRandomIDSize = 32
+	// minRandomIDSize is the smallest Size RandomIDGenerator accepts, IDs
+	// with less than 128 bits can be guessed
+	minRandomIDSize = 16
+)
+
+// IDGenerator creates and validates session IDs
+type IDGenerator interface {
+	// Generate a new session ID
+	Generate() (string, error)
+	// Validate returns true if the ID could have been created by Generate,
+	// it is used to reject malformed cookies without asking the Storer.
+	Validate(id string) bool
+}
+
+// UUIDGenerator generates UUIDv4 session IDs, it is the default IDGenerator
+type UUIDGenerator struct{}
+
+// Generate a new UUIDv4
+func (UUIDGenerator) Generate() (string, error) {
+	uuidID, err := uuid.NewV4()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create uuid for session")
+	}
+
+	return uuidID.String(), nil
+}
+
+// Validate that the id is a UUIDv4
+func (UUIDGenerator) Validate(id string) bool {
+	return validKey(id)
+}
+
+// RandomIDGenerator generates session IDs from Size cryptographically random
+// bytes encoded with unpadded base64url. A Size of 32 gives 256-bit IDs and
+// is the default when Size is 0, sizes below 16 are rejected.
+type RandomIDGenerator struct {
+	Size int
+}
+
+// size returns the number of random bytes in an ID
+func (g RandomIDGenerator) size() int {
+	if g.Size <= 0 {
+		return defaultRandomIDSize
+	}
+
+	return g.Size
+}
+
+// Generate a new random ID
+func (g RandomIDGenerator) Generate() (string, error) {
+	size := g.size()
+	if size < minRandomIDSize {
+		return "", errors.Errorf("random session id size must be at least %d bytes, got %d", minRandomIDSize, size)
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", errors.Wrap(err, "failed to read random bytes for session id")
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Validate that the id is base64url encoded and decodes to Size bytes
+func (g RandomIDGenerator) Validate(id string) bool {
+	size := g.size()
+	if size < minRandomIDSize || len(id) != base64.RawURLEncoding.EncodedLen(size) {
+		return false
+	}
+
+	_, err := base64.RawURLEncoding.DecodeString(id)
+	return err == nil
+}
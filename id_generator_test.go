@@ -0,0 +1,85 @@
+package possessions
+
+import (
+	"testing"
+)
+
+func TestUUIDGenerator(t *testing.T) {
+	t.Parallel()
+
+	g := UUIDGenerator{}
+
+	id, err := g.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.Validate(id) {
+		t.Errorf("expected %q to be valid", id)
+	}
+	if g.Validate("not-a-uuid") {
+		t.Error("expected not-a-uuid to be invalid")
+	}
+}
+
+func TestRandomIDGenerator(t *testing.T) {
+	t.Parallel()
+
+	g := RandomIDGenerator{Size: 32}
+
+	id, err := g.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id) != 43 {
+		t.Errorf("expected a 43 character id, got %q", id)
+	}
+	if !g.Validate(id) {
+		t.Errorf("expected %q to be valid", id)
+	}
+
+	other, err := g.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == other {
+		t.Error("expected ids to be unique")
+	}
+
+	if g.Validate(id[1:]) {
+		t.Error("expected a short id to be invalid")
+	}
+	if g.Validate(id[1:] + "!") {
+		t.Error("expected a non base64url id to be invalid")
+	}
+	if g.Validate("816a1acb-73aa-4a75-bbeb-f371bdad40e8") {
+		t.Error("expected a uuid to be invalid")
+	}
+}
+
+func TestRandomIDGeneratorSize(t *testing.T) {
+	t.Parallel()
+
+	// The zero value uses the default size rather than empty ids
+	g := RandomIDGenerator{}
+	id, err := g.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id) != 43 {
+		t.Errorf("expected a 43 character id, got %q", id)
+	}
+	if !g.Validate(id) {
+		t.Errorf("expected %q to be valid", id)
+	}
+	if g.Validate("") {
+		t.Error("expected an empty id to be invalid")
+	}
+
+	small := RandomIDGenerator{Size: 8}
+	if _, err := small.Generate(); err == nil {
+		t.Error("expected an error for a size below the minimum")
+	}
+	if small.Validate("AAAAAAAAAAA") {
+		t.Error("expected ids below the minimum size to be invalid")
+	}
+}
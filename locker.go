@@ -0,0 +1,95 @@
+package possessions
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// lockPollInterval is how often lockers that can not block on a lock (flock,
+// redis) try to acquire it again
+const lockPollInterval = 10 * time.Millisecond
+
+// Locker provides exclusive locks on session keys so that requests
+// belonging to the same session can be handled one at a time.
+type Locker interface {
+	// Lock blocks until the lock on key is acquired or ctx is done. The
+	// returned function releases the lock.
+	Lock(ctx context.Context, key string) (unlock func(), err error)
+}
+
+// LockKeyer is implemented by overseers that know which Storer key the
+// session of a request is kept under
+type LockKeyer interface {
+	// LockKey returns the key to lock for the request, ok is false if the
+	// request has no session that could be locked
+	LockKey(r *http.Request) (key string, ok bool)
+}
+
+// keyMutex is a set of in-process mutexes, one for each key that is
+// currently locked or waited on
+type keyMutex struct {
+	mut   sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	// ch holds a value while the lock is held
+	ch chan struct{}
+	// refs is the number of holders and waiters
+	refs int
+}
+
+// Lock the key, see Locker
+func (k *keyMutex) Lock(ctx context.Context, key string) (func(), error) {
+	k.mut.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyLock{ch: make(chan struct{}, 1)}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mut.Unlock()
+
+	select {
+	case l.ch <- struct{}{}:
+		return func() {
+			<-l.ch
+			k.release(key, l)
+		}, nil
+	case <-ctx.Done():
+		k.release(key, l)
+		return nil, ctx.Err()
+	}
+}
+
+// release drops a reference to the lock and forgets it once nobody holds
+// or waits on it
+func (k *keyMutex) release(key string, l *keyLock) {
+	k.mut.Lock()
+	l.refs--
+	if l.refs == 0 {
+		delete(k.locks, key)
+	}
+	k.mut.Unlock()
+}
+
+// pollLock calls tryLock until it succeeds, fails or ctx is done
+func pollLock(ctx context.Context, tryLock func() (bool, error)) error {
+	for {
+		locked, err := tryLock()
+		if err != nil || locked {
+			return err
+		}
+
+		select {
+		case <-time.After(lockPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package possessions
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestKeyMutex(t *testing.T) {
+	t.Parallel()
+
+	var k keyMutex
+	ctx := context.Background()
+
+	unlock, err := k.Lock(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other keys are not affected
+	unlockB, err := k.Lock(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockB()
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err = k.Lock(timeoutCtx, "a"); err != context.DeadlineExceeded {
+		t.Errorf("expected lock to time out, got: %v", err)
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := k.Lock(ctx, "a")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		close(locked)
+		unlock()
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("expected lock to still be held")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	unlock()
+	<-locked
+
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	if len(k.locks) != 0 {
+		t.Errorf("expected released locks to be forgotten, got %d", len(k.locks))
+	}
+}
@@ -0,0 +1,525 @@
+package possessions
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The kinds of records in the log
+const (
+	logRecordSet byte = iota + 1
+	logRecordDel
+	logRecordExpiry
+)
+
+const (
+	// logHeaderSize is the size of a record header: crc32, kind, expiry in
+	// unix nanoseconds (0 for never), key length and value length
+	logHeaderSize = 4 + 1 + 8 + 4 + 4
+	// logMaxKeySize and logMaxValueSize are sanity limits for the lengths
+	// in a record header, larger ones mean the record is corrupt
+	logMaxKeySize   = 1 << 16
+	logMaxValueSize = 1 << 30
+)
+
+// errLogCorrupt is returned when reading a record that is not intact
+var errLogCorrupt = errors.New("corrupt log record")
+
+// LogStorer is a session storer implementation for saving sessions in a
+// single append-only file on disk.
+//
+// Every change is appended to the file as a record and an in-memory index
+// points to the latest value of each session, so it copes with millions of
+// sessions where the DiskStorer's folder of files does not. The expiry of
+// each session is kept in its records. Records that were only partially
+// written when the process crashed are discarded when the file is opened.
+// Clean removes expired sessions and compacts the file by rewriting the
+// live sessions once most of it is taken up by old records.
+//
+// The file must only be used by one LogStorer at a time.
+type LogStorer struct {
+	// Path to the log file
+	filePath string
+	// How long sessions take to expire
+	maxAge time.Duration
+	// How often expired sessions should be removed and the log compacted
+	cleanInterval time.Duration
+	// mut protects the file, index, size and live fields
+	mut  sync.RWMutex
+	file *os.File
+	// index holds where the latest value of each session is in the file
+	index map[string]logEntry
+	// size is the size of the file, where the next record is written
+	size int64
+	// live is the size of the records the index points to, the rest of
+	// the file can be reclaimed by compacting it
+	live int64
+	// wg is used to manage the cleaner loop
+	wg sync.WaitGroup
+	// quit channel for exiting the cleaner loop
+	quit chan struct{}
+}
+
+// logEntry is the position of a session's value in the log
+type logEntry struct {
+	// offset and size of the value in the file
+	offset int64
+	size   int
+	// recordSize is the size of the whole record holding the value
+	recordSize int64
+	// expires in unix nanoseconds, 0 for never
+	expires int64
+}
+
+// expired returns true if the entry has expired at now (unix nanoseconds)
+func (e logEntry) expired(now int64) bool {
+	return e.expires != 0 && e.expires <= now
+}
+
+// logRecord is a single record of the log
+type logRecord struct {
+	kind    byte
+	expires int64
+	key     string
+	value   string
+}
+
+// NewDefaultLogStorer returns a LogStorer object with default values.
+// The default values are:
+// filePath: system tmp dir + tmpFile
+// maxAge: 2 days (clear session stored on server after 2 days)
+// cleanInterval: 1 hour (delete sessions older than maxAge every 1 hour)
+func NewDefaultLogStorer(tmpFile string) (*LogStorer, error) {
+	filePath := path.Join(os.TempDir(), tmpFile)
+	return NewLogStorer(filePath, time.Hour*24*2, time.Hour)
+}
+
+// NewLogStorer opens (or creates) the log file at filePath, loads its index
+// and returns a new LogStorer object. It takes the maxAge of how long each
+// session should live, and a cleanInterval duration which defines how often
+// the clean task should remove expired sessions and compact the file.
+// Persistent storage can be attained by setting maxAge and cleanInterval
+// to zero.
+func NewLogStorer(filePath string, maxAge, cleanInterval time.Duration) (*LogStorer, error) {
+	if (maxAge != 0 && cleanInterval == 0) || (cleanInterval != 0 && maxAge == 0) {
+		panic("if max age or clean interval is set, the other must also be set")
+	}
+
+	l := &LogStorer{
+		filePath:      filePath,
+		maxAge:        maxAge,
+		cleanInterval: cleanInterval,
+	}
+
+	// A compaction that did not finish leaves its file behind, the log
+	// itself is only replaced once the compacted file is complete
+	err := os.Remove(l.compactPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "unable to remove file: %s", l.compactPath())
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// open the log file and load the index from it, truncating the file after
+// the last intact record
+func (l *LogStorer) open() error {
+	file, err := os.OpenFile(l.filePath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open log file: %s", l.filePath)
+	}
+
+	l.file = file
+	l.index = make(map[string]logEntry)
+	l.size = 0
+	l.live = 0
+
+	r := bufio.NewReader(file)
+	for {
+		rec, n, err := readLogRecord(r)
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF || err == errLogCorrupt {
+			// The rest of the file was not written completely, drop it
+			if err := file.Truncate(l.size); err != nil {
+				file.Close()
+				return errors.Wrapf(err, "unable to truncate log file: %s", l.filePath)
+			}
+			break
+		} else if err != nil {
+			file.Close()
+			return errors.Wrapf(err, "unable to read log file: %s", l.filePath)
+		}
+
+		l.apply(rec, n)
+	}
+
+	return nil
+}
+
+// Close the log file
+func (l *LogStorer) Close() error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	return l.file.Close()
+}
+
+// All keys in the log
+func (l *LogStorer) All(ctx context.Context) ([]string, error) {
+	now := time.Now().UnixNano()
+
+	l.mut.RLock()
+	defer l.mut.RUnlock()
+
+	sessions := make([]string, 0, len(l.index))
+	for key, entry := range l.index {
+		if !entry.expired(now) {
+			sessions = append(sessions, key)
+		}
+	}
+
+	return sessions, nil
+}
+
+// Get returns the value string saved in the session pointed to by the
+// session id key.
+func (l *LogStorer) Get(ctx context.Context, key string) (value string, err error) {
+	l.mut.RLock()
+	defer l.mut.RUnlock()
+
+	entry, ok := l.index[key]
+	if !ok || entry.expired(time.Now().UnixNano()) {
+		return "", errNoSession{}
+	}
+
+	val := make([]byte, entry.size)
+	if _, err := l.file.ReadAt(val, entry.offset); err != nil {
+		return "", errors.Wrapf(err, "unable to read log file: %s", l.filePath)
+	}
+
+	return string(val), nil
+}
+
+// Set saves the value string to the session pointed to by the session id key.
+func (l *LogStorer) Set(ctx context.Context, key, value string) error {
+	return l.SetWithTTL(ctx, key, value, l.maxAge)
+}
+
+// SetWithTTL saves the value string to the session pointed to by the session
+// id key so that it expires after ttl instead of maxAge.
+func (l *LogStorer) SetWithTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	return l.append(logRecord{kind: logRecordSet, expires: logExpires(ttl), key: key, value: value})
+}
+
+// Del the session pointed to by the session id key and remove it.
+func (l *LogStorer) Del(ctx context.Context, key string) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if _, ok := l.index[key]; !ok {
+		return nil
+	}
+
+	return l.append(logRecord{kind: logRecordDel, key: key})
+}
+
+// ResetExpiry resets the expiry of the key
+func (l *LogStorer) ResetExpiry(ctx context.Context, key string) error {
+	return l.ResetExpiryTTL(ctx, key, l.maxAge)
+}
+
+// ResetExpiryTTL resets the expiry of the key to ttl from now
+func (l *LogStorer) ResetExpiryTTL(ctx context.Context, key string, ttl time.Duration) error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	entry, ok := l.index[key]
+	if !ok || entry.expired(time.Now().UnixNano()) {
+		return errNoSession{}
+	}
+
+	return l.append(logRecord{kind: logRecordExpiry, expires: logExpires(ttl), key: key})
+}
+
+// logExpires returns the expiry of a record for a session living for ttl,
+// sessions with no ttl never expire
+func logExpires(ttl time.Duration) int64 {
+	if ttl == 0 {
+		return 0
+	}
+
+	return time.Now().Add(ttl).UnixNano()
+}
+
+// append the record to the log and apply it to the index, the write lock
+// must be held
+func (l *LogStorer) append(rec logRecord) error {
+	buf := encodeLogRecord(rec)
+	if _, err := l.file.WriteAt(buf, l.size); err != nil {
+		// Drop whatever part of the record was written, it would be
+		// overwritten by the next record anyway
+		_ = l.file.Truncate(l.size)
+		return errors.Wrapf(err, "unable to write log file: %s", l.filePath)
+	}
+
+	l.apply(rec, int64(len(buf)))
+	return nil
+}
+
+// apply a record of n bytes at the end of the log to the index
+func (l *LogStorer) apply(rec logRecord, n int64) {
+	old, exists := l.index[rec.key]
+
+	switch rec.kind {
+	case logRecordSet:
+		if exists {
+			l.live -= old.recordSize
+		}
+		l.index[rec.key] = logEntry{
+			offset:     l.size + logHeaderSize + int64(len(rec.key)),
+			size:       len(rec.value),
+			recordSize: n,
+			expires:    rec.expires,
+		}
+		l.live += n
+	case logRecordDel:
+		if exists {
+			l.live -= old.recordSize
+			delete(l.index, rec.key)
+		}
+	case logRecordExpiry:
+		if exists {
+			old.expires = rec.expires
+			l.index[rec.key] = old
+		}
+	}
+
+	l.size += n
+}
+
+// Clean removes all expired sessions and compacts the log once less than
+// half of it is taken up by live sessions.
+func (l *LogStorer) Clean() error {
+	now := time.Now().UnixNano()
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	for key, entry := range l.index {
+		if entry.expired(now) {
+			l.live -= entry.recordSize
+			delete(l.index, key)
+		}
+	}
+
+	if l.size-l.live <= l.live {
+		return nil
+	}
+
+	return l.compact()
+}
+
+// Compact rewrites the log with only the live sessions in it
+func (l *LogStorer) Compact() error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	return l.compact()
+}
+
+// compact writes the live sessions to a new file and moves it over the log
+// once it is complete, so a crash at any point leaves either the old or the
+// new log in place. The write lock must be held.
+func (l *LogStorer) compact() error {
+	compactPath := l.compactPath()
+	file, err := os.OpenFile(compactPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create file: %s", compactPath)
+	}
+	defer func() {
+		if file != nil {
+			file.Close()
+			os.Remove(compactPath)
+		}
+	}()
+
+	now := time.Now().UnixNano()
+	index := make(map[string]logEntry, len(l.index))
+	var size int64
+
+	w := bufio.NewWriter(file)
+	for key, entry := range l.index {
+		if entry.expired(now) {
+			continue
+		}
+
+		val := make([]byte, entry.size)
+		if _, err := l.file.ReadAt(val, entry.offset); err != nil {
+			return errors.Wrapf(err, "unable to read log file: %s", l.filePath)
+		}
+
+		buf := encodeLogRecord(logRecord{kind: logRecordSet, expires: entry.expires, key: key, value: string(val)})
+		if _, err := w.Write(buf); err != nil {
+			return errors.Wrapf(err, "unable to write file: %s", compactPath)
+		}
+
+		index[key] = logEntry{
+			offset:     size + logHeaderSize + int64(len(key)),
+			size:       entry.size,
+			recordSize: int64(len(buf)),
+			expires:    entry.expires,
+		}
+		size += int64(len(buf))
+	}
+
+	if err := w.Flush(); err != nil {
+		return errors.Wrapf(err, "unable to write file: %s", compactPath)
+	}
+	if err := file.Sync(); err != nil {
+		return errors.Wrapf(err, "unable to sync file: %s", compactPath)
+	}
+	if err := os.Rename(compactPath, l.filePath); err != nil {
+		return errors.Wrapf(err, "unable to replace log file: %s", l.filePath)
+	}
+	syncDir(filepath.Dir(l.filePath))
+
+	l.file.Close()
+	l.file, file = file, nil
+	l.index = index
+	l.size = size
+	l.live = size
+
+	return nil
+}
+
+// compactPath is where the log is compacted to before replacing it
+func (l *LogStorer) compactPath() string {
+	return l.filePath + ".compact"
+}
+
+// syncDir makes a rename in the directory durable where that is supported
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	d.Close()
+}
+
+// encodeLogRecord returns the bytes of the record as they are stored
+func encodeLogRecord(rec logRecord) []byte {
+	buf := make([]byte, logHeaderSize+len(rec.key)+len(rec.value))
+	buf[4] = rec.kind
+	binary.LittleEndian.PutUint64(buf[5:], uint64(rec.expires))
+	binary.LittleEndian.PutUint32(buf[13:], uint32(len(rec.key)))
+	binary.LittleEndian.PutUint32(buf[17:], uint32(len(rec.value)))
+	copy(buf[logHeaderSize:], rec.key)
+	copy(buf[logHeaderSize+len(rec.key):], rec.value)
+	binary.LittleEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+
+	return buf
+}
+
+// readLogRecord reads the next record and its size from r. It returns
+// io.EOF at the end of the log, and io.ErrUnexpectedEOF or errLogCorrupt
+// when the record was not written completely.
+func readLogRecord(r io.Reader) (logRecord, int64, error) {
+	header := make([]byte, logHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return logRecord{}, 0, err
+	}
+
+	keySize := binary.LittleEndian.Uint32(header[13:])
+	valueSize := binary.LittleEndian.Uint32(header[17:])
+	if keySize > logMaxKeySize || valueSize > logMaxValueSize {
+		return logRecord{}, 0, errLogCorrupt
+	}
+
+	buf := make([]byte, logHeaderSize+int(keySize)+int(valueSize))
+	copy(buf, header)
+	if _, err := io.ReadFull(r, buf[logHeaderSize:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return logRecord{}, 0, err
+	}
+
+	if binary.LittleEndian.Uint32(buf) != crc32.ChecksumIEEE(buf[4:]) {
+		return logRecord{}, 0, errLogCorrupt
+	}
+
+	rec := logRecord{
+		kind:    buf[4],
+		expires: int64(binary.LittleEndian.Uint64(buf[5:])),
+		key:     string(buf[logHeaderSize : logHeaderSize+keySize]),
+		value:   string(buf[logHeaderSize+keySize:]),
+	}
+	if rec.kind < logRecordSet || rec.kind > logRecordExpiry {
+		return logRecord{}, 0, errLogCorrupt
+	}
+
+	return rec, int64(len(buf)), nil
+}
+
+// StartCleaner starts the log session cleaner go routine. This go routine
+// will remove expired sessions and compact the log on the cleanInterval
+// interval.
+func (l *LogStorer) StartCleaner() {
+	if l.maxAge == 0 || l.cleanInterval == 0 {
+		panic("both max age and clean interval must be set to non-zero")
+	}
+
+	// init quit chan
+	l.quit = make(chan struct{})
+
+	l.wg.Add(1)
+
+	// Start the cleaner infinite loop go routine.
+	// StopCleaner() can be used to kill this go routine.
+	go l.cleanerLoop()
+}
+
+// StopCleaner stops the cleaner go routine
+func (l *LogStorer) StopCleaner() {
+	close(l.quit)
+	l.wg.Wait()
+}
+
+// cleanerLoop executes the Clean() method every time cleanInterval elapses.
+// StopCleaner() can be used to kill this go routine loop.
+func (l *LogStorer) cleanerLoop() {
+	defer l.wg.Done()
+
+	t, c := timerTestHarness(l.cleanInterval)
+
+	for {
+		select {
+		case <-c:
+			// A failed clean is retried on the next interval
+			_ = l.Clean()
+			t.Reset(l.cleanInterval)
+		case <-l.quit:
+			t.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package possessions
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestLogStorerNewDefault(t *testing.T) {
+	t.Parallel()
+
+	l, err := NewDefaultLogStorer(filepath.Base(t.TempDir()) + ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(l.filePath)
+	defer l.Close()
+
+	if l.maxAge != time.Hour*24*2 {
+		t.Error("expected max age to be 2 days")
+	}
+	if l.cleanInterval != time.Hour {
+		t.Error("expected clean interval to be 1 hour")
+	}
+}
+
+func TestLogStorer(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "sessions.log")
+
+	l, err := NewLogStorer(filePath, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.Get(ctx, "a"); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+	if err := l.ResetExpiry(ctx, "a"); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+
+	for _, kv := range [][2]string{{"a", "hello"}, {"b", "world"}, {"c", "!"}, {"a", "hi"}} {
+		if err := l.Set(ctx, kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Del(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ResetExpiry(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(l *LogStorer) {
+		t.Helper()
+
+		if val, err := l.Get(ctx, "a"); err != nil || val != "hi" {
+			t.Errorf("expected hi, got: %q %v", val, err)
+		}
+		if val, err := l.Get(ctx, "b"); err != nil || val != "world" {
+			t.Errorf("expected world, got: %q %v", val, err)
+		}
+		if _, err := l.Get(ctx, "c"); !IsNoSessionError(err) {
+			t.Errorf("expected c to be deleted, got: %v", err)
+		}
+
+		keys, err := l.All(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(keys)
+		if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+			t.Errorf("expected keys a and b, got: %v", keys)
+		}
+	}
+	check(l)
+
+	// Everything is still there after opening the file again
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = NewLogStorer(filePath, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	check(l)
+}
+
+func TestLogStorerTTL(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "sessions.log")
+
+	l, err := NewLogStorer(filePath, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Set(ctx, "forever", "val"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetWithTTL(ctx, "expired", "val", -time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetWithTTL(ctx, "reset", "val", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ResetExpiryTTL(ctx, "reset", -time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// The expiry is kept in the records, so it survives opening the file
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = NewLogStorer(filePath, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if _, err := l.Get(ctx, "forever"); err != nil {
+		t.Error(err)
+	}
+	for _, key := range []string{"expired", "reset"} {
+		if _, err := l.Get(ctx, key); !IsNoSessionError(err) {
+			t.Errorf("expected %s to have expired, got: %v", key, err)
+		}
+	}
+	if keys, _ := l.All(ctx); len(keys) != 1 {
+		t.Errorf("expected only forever to be listed, got: %v", keys)
+	}
+}
+
+func TestLogStorerTornWrite(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "sessions.log")
+
+	l, err := NewLogStorer(filePath, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set(ctx, "a", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	size := l.size
+	if err := l.Set(ctx, "b", "world"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut the last record short as if the process crashed while writing it
+	if err := os.Truncate(filePath, size+logHeaderSize+1); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = NewLogStorer(filePath, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := l.Get(ctx, "a"); err != nil || val != "hello" {
+		t.Errorf("expected hello, got: %q %v", val, err)
+	}
+	if _, err := l.Get(ctx, "b"); !IsNoSessionError(err) {
+		t.Errorf("expected the torn record to be dropped, got: %v", err)
+	}
+	if l.size != size {
+		t.Errorf("expected the file to be truncated to %d, got: %d", size, l.size)
+	}
+
+	// Corrupt the first record, nothing after it can be trusted
+	if err := l.Set(ctx, "b", "world"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(filePath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte("j"), logHeaderSize+1); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	l, err = NewLogStorer(filePath, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if keys, _ := l.All(ctx); len(keys) != 0 {
+		t.Errorf("expected no sessions, got: %v", keys)
+	}
+}
+
+func TestLogStorerCompact(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "sessions.log")
+
+	l, err := NewLogStorer(filePath, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := l.Set(ctx, "a", "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.SetWithTTL(ctx, "b", "world", -time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set(ctx, "c", "!"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Del(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Clean(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := int64(len(encodeLogRecord(logRecord{kind: logRecordSet, key: "a", value: "hello"})))
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != want {
+		t.Errorf("expected the log to be compacted to %d bytes, got: %d", want, info.Size())
+	}
+	if _, err := os.Stat(l.compactPath()); !os.IsNotExist(err) {
+		t.Errorf("expected the compact file to be gone, got: %v", err)
+	}
+
+	if err := l.Set(ctx, "d", "after"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = NewLogStorer(filePath, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if val, err := l.Get(ctx, "a"); err != nil || val != "hello" {
+		t.Errorf("expected hello, got: %q %v", val, err)
+	}
+	if val, err := l.Get(ctx, "d"); err != nil || val != "after" {
+		t.Errorf("expected after, got: %q %v", val, err)
+	}
+	if keys, _ := l.All(ctx); len(keys) != 2 {
+		t.Errorf("expected a and d, got: %v", keys)
+	}
+}
+
+func TestLogStorerCleaner(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "sessions.log")
+
+	l, err := NewLogStorer(filePath, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	tm := memoryTestTimer{}
+	ch := make(chan time.Time)
+	timerTestHarness = func(d time.Duration) (timer, <-chan time.Time) {
+		return tm, ch
+	}
+
+	if err := l.Set(ctx, "testid1", "test1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetWithTTL(ctx, "testid2", "test2", -time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start the cleaner go routine
+	l.StartCleaner()
+
+	// Signal the timer channel to execute the clean
+	ch <- time.Time{}
+
+	// Stop the cleaner, this will block until the cleaner has finished its operations
+	l.StopCleaner()
+
+	if len(l.index) != 1 {
+		t.Errorf("expected len 1, got %d", len(l.index))
+	}
+	if _, ok := l.index["testid2"]; ok {
+		t.Error("expected testid2 to be deleted, but was not")
+	}
+}
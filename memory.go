@@ -17,6 +17,8 @@ type MemoryStorer struct {
 	cleanInterval time.Duration
 	// session storage mutex
 	mut sync.RWMutex
+	// locks holds the session locks handed out by Lock
+	locks keyMutex
 	// wg is used to manage the cleaner go routines
 	wg sync.WaitGroup
 	// quit channel for exiting the cleaner loop
@@ -87,9 +89,15 @@ func (m *MemoryStorer) Get(ctx context.Context, key string) (value string, err e
 
 // Set saves the value string to the session pointed to by the session id key.
 func (m *MemoryStorer) Set(ctx context.Context, key, value string) error {
+	return m.SetWithTTL(ctx, key, value, m.maxAge)
+}
+
+// SetWithTTL saves the value string to the session pointed to by the session
+// id key so that it expires after ttl instead of maxAge.
+func (m *MemoryStorer) SetWithTTL(ctx context.Context, key, value string, ttl time.Duration) error {
 	m.mut.Lock()
 	m.sessions[key] = memorySession{
-		expires: time.Now().UTC().Add(m.maxAge),
+		expires: time.Now().UTC().Add(ttl),
 		value:   value,
 	}
 	m.mut.Unlock()
@@ -97,6 +105,42 @@ func (m *MemoryStorer) Set(ctx context.Context, key, value string) error {
 	return nil
 }
 
+// GetVersion returns the value string saved in the session pointed to by the
+// session id key and its version.
+func (m *MemoryStorer) GetVersion(ctx context.Context, key string) (value, version string, err error) {
+	value, err = m.Get(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	return value, valueVersion(value), nil
+}
+
+// CompareAndSet saves the value string to the session pointed to by the
+// session id key if its version still matches.
+func (m *MemoryStorer) CompareAndSet(ctx context.Context, key, value, version string) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	session, ok := m.sessions[key]
+	if ok != (len(version) != 0) || (ok && valueVersion(session.value) != version) {
+		return errVersionConflict{}
+	}
+
+	m.sessions[key] = memorySession{
+		expires: time.Now().UTC().Add(m.maxAge),
+		value:   value,
+	}
+
+	return nil
+}
+
+// Lock the session pointed to by the session id key, the lock is only held
+// within this process.
+func (m *MemoryStorer) Lock(ctx context.Context, key string) (func(), error) {
+	return m.locks.Lock(ctx, key)
+}
+
 // Del the session pointed to by the session id key and remove it.
 func (m *MemoryStorer) Del(ctx context.Context, key string) error {
 	m.mut.Lock()
@@ -108,14 +152,20 @@ func (m *MemoryStorer) Del(ctx context.Context, key string) error {
 
 // ResetExpiry resets the expiry of the key
 func (m *MemoryStorer) ResetExpiry(ctx context.Context, key string) error {
-	m.mut.RLock()
+	return m.ResetExpiryTTL(ctx, key, m.maxAge)
+}
+
+// ResetExpiryTTL resets the expiry of the key to ttl from now
+func (m *MemoryStorer) ResetExpiryTTL(ctx context.Context, key string, ttl time.Duration) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
 	session, ok := m.sessions[key]
-	m.mut.RUnlock()
 	if !ok {
 		return errNoSession{}
 	}
 
-	session.expires = time.Now().UTC().Add(m.maxAge)
+	session.expires = time.Now().UTC().Add(ttl)
 	m.sessions[key] = session
 	return nil
 }
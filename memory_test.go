@@ -248,3 +248,121 @@ func TestMemoryStorerResetExpiry(t *testing.T) {
 		t.Errorf("Expected newexpires to be newer than old expires, got: %#v, %#v", oldExpires, newExpires)
 	}
 }
+
+func TestMemoryStorerCompareAndSet(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	if err = m.CompareAndSet(ctx, "hi", "hello", "nope"); !IsVersionConflictError(err) {
+		t.Errorf("expected version conflict for missing key, got: %v", err)
+	}
+	if err = m.CompareAndSet(ctx, "hi", "hello", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.CompareAndSet(ctx, "hi", "hello", ""); !IsVersionConflictError(err) {
+		t.Errorf("expected version conflict for existing key, got: %v", err)
+	}
+
+	val, version, err := m.GetVersion(ctx, "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "hello" {
+		t.Errorf("expected %q, got %q", "hello", val)
+	}
+
+	if err = m.Set(ctx, "hi", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.CompareAndSet(ctx, "hi", "world", version); !IsVersionConflictError(err) {
+		t.Errorf("expected version conflict for changed key, got: %v", err)
+	}
+
+	_, version, err = m.GetVersion(ctx, "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.CompareAndSet(ctx, "hi", "world", version); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ = m.Get(ctx, "hi"); val != "world" {
+		t.Errorf("expected %q, got %q", "world", val)
+	}
+}
+
+func TestMemoryStorerLock(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	unlock, err := m.Lock(ctx, "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err = m.Lock(timeoutCtx, "hi"); err == nil {
+		t.Error("expected lock to time out")
+	}
+
+	unlock()
+	unlock, err = m.Lock(ctx, "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
+
+func TestMemoryStorerTTL(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewMemoryStorer(time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	if err = m.SetWithTTL(ctx, "short", "hello", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.SetWithTTL(ctx, "long", "hello", time.Hour*24*30); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Set(ctx, "default", "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Clean()
+
+	if _, err = m.Get(ctx, "short"); !IsNoSessionError(err) {
+		t.Errorf("expected short session to be expired, got: %v", err)
+	}
+	if _, err = m.Get(ctx, "default"); err != nil {
+		t.Error(err)
+	}
+
+	if err = m.ResetExpiryTTL(ctx, "long", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	m.Clean()
+	if _, err = m.Get(ctx, "long"); !IsNoSessionError(err) {
+		t.Errorf("expected long session to be expired, got: %v", err)
+	}
+
+	if err = m.ResetExpiryTTL(ctx, "missing", time.Hour); !IsNoSessionError(err) {
+		t.Errorf("expected ErrNoSession, got: %v", err)
+	}
+}
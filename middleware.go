@@ -1,11 +1,19 @@
 package possessions
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+	"time"
+)
 
 // RefreshMiddleware refreshes sessions on each request
-type RefreshMiddleware struct{}
+type RefreshMiddleware struct {
+	lifetime time.Duration
+	fraction float64
+}
 type refreshSession struct {
 	handler http.Handler
+	RefreshMiddleware
 }
 
 // NewRefreshMiddleware creates a refresh middleware
@@ -13,16 +21,111 @@ func NewRefreshMiddleware() RefreshMiddleware {
 	return RefreshMiddleware{}
 }
 
+// NewThrottledRefreshMiddleware creates a refresh middleware that only
+// refreshes a session once more than fraction of its lifetime has passed
+// since it was last refreshed. Sessions given a TTL with SetTTL use it as
+// their lifetime. The last refresh is tracked by the StorageOverseer, other
+// overseers are refreshed on each request.
+func NewThrottledRefreshMiddleware(lifetime time.Duration, fraction float64) RefreshMiddleware {
+	return RefreshMiddleware{
+		lifetime: lifetime,
+		fraction: fraction,
+	}
+}
+
 // Wrap wraps a handler with refreshing middleware
 func (r RefreshMiddleware) Wrap(h http.Handler) http.Handler {
-	return refreshSession{handler: h}
+	return refreshSession{handler: h, RefreshMiddleware: r}
 }
 
 func (r refreshSession) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	pw := getResponseWriter(w)
-	pw.events = append(pw.events, Event{
-		Kind: EventRefresh,
-	})
+	if r.due(req.Context()) {
+		ev := Event{Kind: EventRefresh}
+		// Only throttling needs to know when the session was last refreshed
+		if r.lifetime != 0 {
+			ev.Refreshed = time.Now()
+		}
+
+		pw := getResponseWriter(w)
+		pw.events = append(pw.events, ev)
+	}
 
 	r.handler.ServeHTTP(w, req)
 }
+
+// due returns true if the session in ctx should be refreshed
+func (r RefreshMiddleware) due(ctx context.Context) bool {
+	if r.lifetime == 0 {
+		return true
+	}
+
+	sess, ok := ctx.Value(CTXKeyPossessions{}).(session)
+	if !ok || sess.refreshed.IsZero() {
+		return true
+	}
+
+	lifetime := r.lifetime
+	if sess.ttl != 0 {
+		lifetime = sess.ttl
+	}
+
+	return time.Since(sess.refreshed) > time.Duration(float64(lifetime)*r.fraction)
+}
+
+// LockingMiddleware serializes requests belonging to the same session by
+// holding a lock on it while the request is handled. It must wrap the
+// OverseeingMiddleware so the lock is held from ReadState until WriteState.
+type LockingMiddleware struct {
+	keyer   LockKeyer
+	locker  Locker
+	timeout time.Duration
+}
+type lockSession struct {
+	handler http.Handler
+	LockingMiddleware
+}
+
+// NewLockingMiddleware creates a locking middleware. The keyer is usually
+// the StorageOverseer and the locker its Storer. Requests that can not get
+// the lock within timeout are answered with a 503, a timeout of 0 waits for
+// as long as the request lives.
+func NewLockingMiddleware(keyer LockKeyer, locker Locker, timeout time.Duration) LockingMiddleware {
+	return LockingMiddleware{
+		keyer:   keyer,
+		locker:  locker,
+		timeout: timeout,
+	}
+}
+
+// Wrap wraps a handler with locking middleware
+func (l LockingMiddleware) Wrap(h http.Handler) http.Handler {
+	return lockSession{handler: h, LockingMiddleware: l}
+}
+
+func (l lockSession) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	key, ok := l.keyer.LockKey(req)
+	if !ok {
+		// There is no session yet, so nothing to serialize
+		l.handler.ServeHTTP(w, req)
+		return
+	}
+
+	ctx := req.Context()
+	if l.timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+
+	unlock, err := l.locker.Lock(ctx, key)
+	if IsNoSessionError(err) {
+		l.handler.ServeHTTP(w, req)
+		return
+	} else if err != nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer unlock()
+
+	l.handler.ServeHTTP(w, req)
+}
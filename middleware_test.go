@@ -2,9 +2,13 @@ package possessions
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestRefreshMiddleware(t *testing.T) {
@@ -31,3 +35,128 @@ func TestRefreshMiddleware(t *testing.T) {
 		t.Error("the handler should have been called")
 	}
 }
+
+func TestLockingMiddleware(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	uuid := "816a1acb-73aa-4a75-bbeb-f371bdad40e8"
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Set(ctx, uuid, `{}`); err != nil {
+		t.Fatal(err)
+	}
+
+	overseer := NewStorageOverseer(NewCookieOptions(), m)
+
+	var active, maxActive int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		if n > atomic.LoadInt32(&maxActive) {
+			atomic.StoreInt32(&maxActive, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+		Set(w, r.URL.Path, "x")
+		atomic.AddInt32(&active, -1)
+	})
+
+	locking := NewLockingMiddleware(overseer, m, time.Second)
+	h := locking.Wrap(NewOverseeingMiddleware(overseer).Wrap(handler))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", fmt.Sprintf("/%d", i), nil)
+			r.AddCookie(&http.Cookie{Name: "id", Value: uuid})
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != http.StatusOK {
+				t.Errorf("expected status %d, got %d", http.StatusOK, rec.Code)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if maxActive != 1 {
+		t.Errorf("expected requests to be serialized, got %d at once", maxActive)
+	}
+	val, err := m.Get(ctx, uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != `{"/0":"x","/1":"x","/2":"x","/3":"x"}` {
+		t.Errorf("expected every write to be kept, got: %s", val)
+	}
+
+	// Requests that can't get the lock in time are turned away
+	unlock, err := m.Lock(ctx, uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	h = NewLockingMiddleware(overseer, m, 10*time.Millisecond).Wrap(handler)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: uuid})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+
+	// Requests without a session are not locked
+	called := false
+	h = NewLockingMiddleware(overseer, m, 10*time.Millisecond).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !called {
+		t.Error("expected the handler to be called")
+	}
+}
+
+func TestThrottledRefreshMiddleware(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	tests := []struct {
+		Name    string
+		Session Session
+		Refresh bool
+	}{
+		{Name: "NoSession", Refresh: true},
+		{Name: "NeverRefreshed", Session: session{}, Refresh: true},
+		{Name: "Recent", Session: session{refreshed: now.Add(-10 * time.Minute)}},
+		{Name: "Old", Session: session{refreshed: now.Add(-40 * time.Minute)}, Refresh: true},
+		{Name: "LongTTL", Session: session{refreshed: now.Add(-40 * time.Minute), ttl: 24 * time.Hour}},
+	}
+
+	refresh := NewThrottledRefreshMiddleware(time.Hour, 0.5)
+	handler := refresh.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, test := range tests {
+		ctx := context.WithValue(context.Background(), CTXKeyPossessions{}, test.Session)
+		w := newResponseWriter(ctx, httptest.NewRecorder(), nil, test.Session)
+		r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+
+		handler.ServeHTTP(w, r)
+
+		if refreshed := len(w.events) == 1 && w.events[0].Kind == EventRefresh; refreshed != test.Refresh {
+			t.Errorf("%s: expected refresh to be %t, got events: %v", test.Name, test.Refresh, w.events)
+		} else if refreshed && w.events[0].Refreshed.IsZero() {
+			t.Errorf("%s: expected the refresh to carry its time", test.Name)
+		}
+	}
+
+	// Refreshes that are not throttled do not need their time stored
+	w := newResponseWriter(context.Background(), httptest.NewRecorder(), nil, nil)
+	NewRefreshMiddleware().Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if len(w.events) != 1 || !w.events[0].Refreshed.IsZero() {
+		t.Errorf("expected a refresh without a time, got events: %v", w.events)
+	}
+}
@@ -0,0 +1,109 @@
+package possessions
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// record is the stored form of a session that carries metadata
+type record struct {
+	// Created is when the session was created, in unix seconds
+	Created int64 `json:"created,omitempty"`
+	// TTL is how long the session lives as set by SetTTL, in seconds
+	TTL int64 `json:"ttl,omitempty"`
+	// Refreshed is when the session was last refreshed, in unix seconds
+	Refreshed int64                      `json:"refreshed,omitempty"`
+	Values    map[string]json.RawMessage `json:"values"`
+}
+
+// encodeRecord encodes the session for the Storer with the codec, prefixed
+// by its header. With the JSONCodec sessions without metadata are stored as
+// their json encoded values alone so they stay readable by older versions.
+func encodeRecord(sessionObj session, codec Codec) (string, error) {
+	_, isJSON := codec.(JSONCodec)
+	if isJSON && sessionObj.created.IsZero() && sessionObj.ttl == 0 && sessionObj.refreshed.IsZero() {
+		encodedValues, err := json.Marshal(sessionObj.Values)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to marshal session values to json")
+		}
+		return string(encodedValues), nil
+	}
+
+	rec := record{
+		TTL:    int64(sessionObj.ttl / time.Second),
+		Values: sessionObj.Values,
+	}
+	if !sessionObj.created.IsZero() {
+		rec.Created = sessionObj.created.Unix()
+	}
+	if !sessionObj.refreshed.IsZero() {
+		rec.Refreshed = sessionObj.refreshed.Unix()
+	}
+
+	encodedRecord, err := codec.Marshal(&rec)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal session record")
+	}
+
+	return string(codec.Header()) + string(encodedRecord), nil
+}
+
+// decodeRecord decodes a session stored by encodeRecord (and possibly
+// compressed) into sessionObj. The codec is chosen by the header from codecs
+// and the built in ones.
+func decodeRecord(encoded string, sessionObj *session, codecs ...Codec) error {
+	encoded, err := decompress(encoded)
+	if err != nil {
+		return err
+	}
+
+	if len(encoded) == 0 || encoded[0] == '{' {
+		sessionObj.Values = make(map[string]json.RawMessage)
+		sessionObj.created = time.Time{}
+		sessionObj.ttl = 0
+		sessionObj.refreshed = time.Time{}
+		return json.Unmarshal([]byte(encoded), &sessionObj.Values)
+	}
+
+	codec := findCodec(encoded[0], codecs)
+	if codec == nil {
+		return errors.Errorf("no codec for stored session with header %q", encoded[0])
+	}
+
+	var rec record
+	if err := codec.Unmarshal([]byte(encoded[1:]), &rec); err != nil {
+		return err
+	}
+
+	sessionObj.Values = rec.Values
+	if sessionObj.Values == nil {
+		sessionObj.Values = make(map[string]json.RawMessage)
+	}
+	sessionObj.created = time.Time{}
+	if rec.Created != 0 {
+		sessionObj.created = time.Unix(rec.Created, 0)
+	}
+	sessionObj.ttl = time.Duration(rec.TTL) * time.Second
+	sessionObj.refreshed = time.Time{}
+	if rec.Refreshed != 0 {
+		sessionObj.refreshed = time.Unix(rec.Refreshed, 0)
+	}
+
+	return nil
+}
+
+// findCodec returns the codec with the header, looking through codecs
+// before the built in ones
+func findCodec(header byte, codecs []Codec) Codec {
+	for _, list := range [][]Codec{codecs, builtinCodecs} {
+		for _, codec := range list {
+			if codec != nil && codec.Header() == header {
+				return codec
+			}
+		}
+	}
+
+	return nil
+}
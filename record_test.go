@@ -0,0 +1,49 @@
+package possessions
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRecordEncoding(t *testing.T) {
+	t.Parallel()
+
+	// Sessions without metadata are stored as plain json values
+	encoded, err := encodeRecord(session{Values: map[string]json.RawMessage{"a": rawString("b")}}, JSONCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded != `{"a":"b"}` {
+		t.Errorf("expected plain json values, got: %s", encoded)
+	}
+
+	var sessionObj session
+	if err = decodeRecord(encoded, &sessionObj); err != nil {
+		t.Fatal(err)
+	}
+	if string(sessionObj.Values["a"]) != `"b"` || !sessionObj.created.IsZero() {
+		t.Errorf("expected values without metadata, got: %#v", sessionObj)
+	}
+
+	created := time.Unix(1600000000, 0)
+	encoded, err = encodeRecord(session{Values: map[string]json.RawMessage{"a": rawString("b")}, created: created}, JSONCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded != `r{"created":1600000000,"values":{"a":"b"}}` {
+		t.Errorf("expected a record, got: %s", encoded)
+	}
+
+	sessionObj = session{}
+	if err = decodeRecord(encoded, &sessionObj); err != nil {
+		t.Fatal(err)
+	}
+	if string(sessionObj.Values["a"]) != `"b"` || !sessionObj.created.Equal(created) {
+		t.Errorf("expected values and metadata, got: %#v", sessionObj)
+	}
+
+	if err = decodeRecord("r{", &sessionObj); err == nil {
+		t.Error("expected an error for a malformed record")
+	}
+}
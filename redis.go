@@ -2,18 +2,69 @@ package possessions
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
 )
 
+// redisCompareAndSet sets KEYS[1] to ARGV[2] with an expiry of ARGV[3]
+// milliseconds (none if 0) only if the sha1 of its current value is ARGV[1],
+// or if it does not exist and ARGV[1] is empty. It returns 1 if it was set.
+var redisCompareAndSet = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if current == false then
+	if ARGV[1] ~= "" then
+		return 0
+	end
+elseif redis.sha1hex(current) ~= ARGV[1] then
+	return 0
+end
+
+if tonumber(ARGV[3]) > 0 then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+else
+	redis.call("SET", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// redisUnlock deletes the lock KEYS[1] only if it still holds the token
+// ARGV[1], so a lock that expired and was taken by someone else is left alone
+var redisUnlock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// redisLockPrefix is put in front of a session ID (after the KeyPrefix) to
+// make the key of its lock
+const redisLockPrefix = "lock:"
+
+// defaultRedisLockTTL is how long a session lock is held when its holder
+// never releases it
+const defaultRedisLockTTL = 30 * time.Second
+
 // RedisStorer is a session storer implementation for saving sessions
 // to a Redis database.
 type RedisStorer struct {
+	// LockTTL is how long a lock taken by Lock lives when it is not
+	// released, for example because the server crashed. Defaults to 30s.
+	LockTTL time.Duration
+	// KeyPrefix is put in front of the session IDs to make the Redis keys,
+	// so sessions can share a database with other keys without All
+	// returning those or IDs colliding with them. For example "session:".
+	KeyPrefix string
+
 	// How long sessions take to expire in Redis
 	maxAge time.Duration
-	client *redis.Client
+	client redis.UniversalClient
 }
 
 // NewDefaultRedisStorer takes a bind address of the Redis server host:port and
@@ -48,9 +99,22 @@ func NewRedisStorer(opts redis.Options, maxAge time.Duration) (*RedisStorer, err
 	return r, nil
 }
 
+// NewRedisStorerUniversal behaves the same as NewRedisStorer but connects to
+// a Redis Cluster when more than one address is given, or to a Sentinel
+// managed master when a MasterName is given.
+func NewRedisStorerUniversal(opts redis.UniversalOptions, maxAge time.Duration) (*RedisStorer, error) {
+	r := &RedisStorer{
+		maxAge: maxAge,
+		client: redis.NewUniversalClient(&opts),
+	}
+
+	return r, nil
+}
+
 // NewRedisStorerClient behaves the same as NewRedisStorer but does not create
-// a new connection pool.
-func NewRedisStorerClient(client *redis.Client, maxAge time.Duration) (*RedisStorer, error) {
+// a new connection pool. The client can be a *redis.Client (including a
+// failover client), a *redis.ClusterClient or a *redis.Ring.
+func NewRedisStorerClient(client redis.UniversalClient, maxAge time.Duration) (*RedisStorer, error) {
 	r := &RedisStorer{
 		maxAge: maxAge,
 		client: client,
@@ -59,22 +123,85 @@ func NewRedisStorerClient(client *redis.Client, maxAge time.Duration) (*RedisSto
 	return r, nil
 }
 
-// All keys in the redis store
+// key returns the Redis key of the session id key
+func (r *RedisStorer) key(key string) string {
+	return r.KeyPrefix + key
+}
+
+// All keys in the redis store, when KeyPrefix is set only the keys
+// starting with it are returned (without the prefix). With a Redis Cluster
+// every master is scanned, and with a Ring every shard.
 func (r *RedisStorer) All(ctx context.Context) ([]string, error) {
+	var forEach func(ctx context.Context, fn func(ctx context.Context, client *redis.Client) error) error
+	switch client := r.client.(type) {
+	case *redis.ClusterClient:
+		forEach = client.ForEachMaster
+	case *redis.Ring:
+		forEach = client.ForEachShard
+	default:
+		return r.scan(ctx, r.client)
+	}
+
+	var sessions []string
+	var mut sync.Mutex
+	err := forEach(ctx, func(ctx context.Context, client *redis.Client) error {
+		keys, err := r.scan(ctx, client)
+		if err != nil {
+			return err
+		}
+
+		mut.Lock()
+		sessions = append(sessions, keys...)
+		mut.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// scan returns the session ids of all keys on a single node
+func (r *RedisStorer) scan(ctx context.Context, client redis.Cmdable) ([]string, error) {
 	var sessions []string
 
-	iter := r.client.Scan(ctx, 0, "", 0).Iterator()
+	match := ""
+	if r.KeyPrefix != "" {
+		match = redisEscapeGlob(r.KeyPrefix) + "*"
+	}
+
+	iter := client.Scan(ctx, 0, match, 0).Iterator()
 	for iter.Next(ctx) {
-		sessions = append(sessions, iter.Val())
+		key := strings.TrimPrefix(iter.Val(), r.KeyPrefix)
+		if strings.HasPrefix(key, redisLockPrefix) {
+			continue
+		}
+		sessions = append(sessions, key)
 	}
 	err := iter.Err()
 	return sessions, errors.Wrap(err, "unable to iterate redis store")
 }
 
+// redisEscapeGlob escapes the characters that have a special meaning in
+// the patterns of SCAN MATCH
+func redisEscapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
 // Get returns the value string saved in the session pointed to by the
 // session id key.
 func (r *RedisStorer) Get(ctx context.Context, key string) (value string, err error) {
-	val, err := r.client.Get(ctx, key).Result()
+	val, err := r.client.Get(ctx, r.key(key)).Result()
 	if err == redis.Nil {
 		return "", errNoSession{}
 	} else if err != nil {
@@ -86,15 +213,117 @@ func (r *RedisStorer) Get(ctx context.Context, key string) (value string, err er
 
 // Set saves the value string to the session pointed to by the session id key.
 func (r *RedisStorer) Set(ctx context.Context, key, value string) error {
-	return r.client.Set(ctx, key, value, r.maxAge).Err()
+	return r.client.Set(ctx, r.key(key), value, r.maxAge).Err()
+}
+
+// GetVersion returns the value string saved in the session pointed to by the
+// session id key and its version.
+func (r *RedisStorer) GetVersion(ctx context.Context, key string) (value, version string, err error) {
+	value, err = r.Get(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	return value, valueVersion(value), nil
+}
+
+// CompareAndSet saves the value string to the session pointed to by the
+// session id key if its version still matches. The comparison is done
+// atomically by a lua script on the server.
+func (r *RedisStorer) CompareAndSet(ctx context.Context, key, value, version string) error {
+	return r.compareAndSet(ctx, key, value, version, r.maxAge)
+}
+
+// CompareAndSetAndRefresh behaves like CompareAndSet but expires the session
+// after ttl (or maxAge when ttl is 0), in the same lua script call.
+func (r *RedisStorer) CompareAndSetAndRefresh(ctx context.Context, key, value, version string, ttl time.Duration) error {
+	if ttl == 0 {
+		ttl = r.maxAge
+	}
+
+	return r.compareAndSet(ctx, key, value, version, ttl)
+}
+
+func (r *RedisStorer) compareAndSet(ctx context.Context, key, value, version string, ttl time.Duration) error {
+	set, err := redisCompareAndSet.Run(ctx, r.client, []string{r.key(key)}, version, value, ttl.Milliseconds()).Int()
+	if err != nil {
+		return errors.Wrap(err, "unable to compare and set session")
+	}
+	if set == 0 {
+		return errVersionConflict{}
+	}
+
+	return nil
+}
+
+// Lock the session pointed to by the session id key. The lock is a separate
+// key holding a random token that is set with SET NX PX and only deleted by
+// the holder of the token.
+func (r *RedisStorer) Lock(ctx context.Context, key string) (func(), error) {
+	ttl := r.LockTTL
+	if ttl == 0 {
+		ttl = defaultRedisLockTTL
+	}
+
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, errors.Wrap(err, "failed to read random bytes for lock token")
+	}
+	token := hex.EncodeToString(b)
+	lockKey := r.key(redisLockPrefix + key)
+
+	err := pollLock(ctx, func() (bool, error) {
+		return r.client.SetNX(ctx, lockKey, token, ttl).Result()
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to lock session")
+	}
+
+	return func() {
+		// The request context may be done by now, if this fails the lock
+		// expires after the ttl
+		redisUnlock.Run(context.Background(), r.client, []string{lockKey}, token)
+	}, nil
+}
+
+// SetWithTTL saves the value string to the session pointed to by the session
+// id key so that it expires after ttl instead of maxAge.
+func (r *RedisStorer) SetWithTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+	return r.client.Set(ctx, r.key(key), value, ttl).Err()
+}
+
+// SetAndRefresh saves the value string to the session pointed to by the
+// session id key and resets its expiry to ttl (or maxAge when ttl is 0) with
+// a single SET command.
+func (r *RedisStorer) SetAndRefresh(ctx context.Context, key, value string, ttl time.Duration) error {
+	if ttl == 0 {
+		ttl = r.maxAge
+	}
+
+	return r.client.Set(ctx, r.key(key), value, ttl).Err()
 }
 
 // Del the session pointed to by the session id key and remove it.
 func (r *RedisStorer) Del(ctx context.Context, key string) error {
-	return r.client.Del(ctx, key).Err()
+	return r.client.Del(ctx, r.key(key)).Err()
 }
 
-// ResetExpiry resets the expiry of the key
+// ResetExpiry resets the expiry of the key, it returns errNoSession if the
+// key does not exist
 func (r *RedisStorer) ResetExpiry(ctx context.Context, key string) error {
-	return r.client.Expire(ctx, key, r.maxAge).Err()
+	return r.ResetExpiryTTL(ctx, key, r.maxAge)
+}
+
+// ResetExpiryTTL resets the expiry of the key to ttl from now, it returns
+// errNoSession if the key does not exist
+func (r *RedisStorer) ResetExpiryTTL(ctx context.Context, key string, ttl time.Duration) error {
+	ok, err := r.client.Expire(ctx, r.key(key), ttl).Result()
+	if err != nil {
+		return errors.Wrap(err, "unable to reset session expiry")
+	}
+	if !ok {
+		return errNoSession{}
+	}
+
+	return nil
 }
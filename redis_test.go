@@ -1,7 +1,16 @@
 package possessions
 
 import (
+	"bufio"
 	"context"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -251,3 +260,575 @@ func TestRedisStorerResetExpiry(t *testing.T) {
 	// Cleanup
 	storer.Del(ctx, "test")
 }
+
+func TestRedisStorerCompareAndSet(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping long test")
+	}
+
+	storer, err := NewDefaultRedisStorer("", "", 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testidUUID, err := uuid.NewV4()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testid1 := testidUUID.String()
+	ctx := context.Background()
+
+	if err = storer.CompareAndSet(ctx, testid1, "hello", "nope"); !IsVersionConflictError(err) {
+		t.Errorf("expected version conflict for missing key, got: %v", err)
+	}
+	if err = storer.CompareAndSet(ctx, testid1, "hello", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	_, version, err := storer.GetVersion(ctx, testid1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storer.Set(ctx, testid1, "changed")
+	if err = storer.CompareAndSet(ctx, testid1, "world", version); !IsVersionConflictError(err) {
+		t.Errorf("expected version conflict for changed key, got: %v", err)
+	}
+
+	_, version, err = storer.GetVersion(ctx, testid1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = storer.CompareAndSet(ctx, testid1, "world", version); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := storer.Get(ctx, testid1); val != "world" {
+		t.Errorf("expected %q, got %q", "world", val)
+	}
+
+	// Cleanup
+	storer.Del(ctx, testid1)
+}
+
+func TestRedisStorerLock(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping long test")
+	}
+
+	storer, err := NewDefaultRedisStorer("", "", 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storer.LockTTL = time.Second
+
+	testidUUID, err := uuid.NewV4()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testid1 := testidUUID.String()
+	ctx := context.Background()
+
+	unlock, err := storer.Lock(ctx, testid1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err = storer.Lock(timeoutCtx, testid1); err == nil {
+		t.Error("expected lock to time out")
+	}
+
+	unlock()
+	unlock, err = storer.Lock(ctx, testid1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Locks that are never released expire
+	unlock, err = storer.Lock(ctx, testid1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
+
+func TestRedisStorerTTL(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping long test")
+	}
+
+	storer, err := NewDefaultRedisStorer("", "", 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testidUUID, err := uuid.NewV4()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testid1 := testidUUID.String()
+	ctx := context.Background()
+
+	if err = storer.SetWithTTL(ctx, testid1, "hello", time.Hour*24*30); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := storer.client.TTL(ctx, testid1).Val(); ttl <= storer.maxAge {
+		t.Errorf("expected ttl to be longer than max age, got: %v", ttl)
+	}
+
+	if err = storer.ResetExpiryTTL(ctx, testid1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := storer.client.TTL(ctx, testid1).Val(); ttl > time.Hour {
+		t.Errorf("expected ttl to be an hour, got: %v", ttl)
+	}
+
+	// Cleanup
+	storer.Del(ctx, testid1)
+}
+
+func TestRedisEscapeGlob(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"session:": "session:",
+		"a*b?c":    `a\*b\?c`,
+		`[x]\`:     `\[x\]\\`,
+		"":         "",
+	}
+
+	for in, want := range tests {
+		if got := redisEscapeGlob(in); got != want {
+			t.Errorf("%q: expected %q, got %q", in, want, got)
+		}
+	}
+}
+
+func TestRedisStorerKeyPrefix(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping long test")
+	}
+
+	storer, err := NewDefaultRedisStorer("", "", 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storer.KeyPrefix = "possessions*test:"
+
+	testidUUID, err := uuid.NewV4()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testid1 := testidUUID.String()
+	ctx := context.Background()
+
+	if err = storer.Set(ctx, testid1, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	// An unrelated key that the unescaped prefix would match
+	if err = storer.client.Set(ctx, "possessions-other-test:"+testid1, "cache", time.Minute).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if val := storer.client.Get(ctx, storer.KeyPrefix+testid1).Val(); val != "hello" {
+		t.Errorf("expected the session to be stored under the prefix, got: %q", val)
+	}
+	if val, err := storer.Get(ctx, testid1); err != nil || val != "hello" {
+		t.Errorf("expected hello, got: %q %v", val, err)
+	}
+
+	unlock, err := storer.Lock(ctx, testid1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := storer.All(ctx)
+	unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0] != testid1 {
+		t.Errorf("expected only %s without the prefix, got: %v", testid1, list)
+	}
+
+	if err = storer.ResetExpiry(ctx, testid1); err != nil {
+		t.Error(err)
+	}
+	if err = storer.Del(ctx, testid1); err != nil {
+		t.Error(err)
+	}
+	if _, err = storer.Get(ctx, testid1); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+
+	// Cleanup
+	storer.client.Del(ctx, "possessions-other-test:"+testid1)
+}
+
+// redisStandIn is a local stand-in for a Redis node that understands just
+// enough of the protocol for the RedisStorer, and for a Redis Cluster client
+// when it is one of several nodes sharing the slots
+type redisStandIn struct {
+	listener net.Listener
+	// cluster holds the addresses of every node when it is part of one
+	cluster []string
+
+	mut  sync.Mutex
+	data map[string]string
+	// ttls holds the expiry last set on each key
+	ttls map[string]time.Duration
+}
+
+func newRedisStandIn(t *testing.T) *redisStandIn {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &redisStandIn{listener: listener, data: make(map[string]string), ttls: make(map[string]time.Duration)}
+	t.Cleanup(func() { listener.Close() })
+	go r.serve()
+
+	return r
+}
+
+func (r *redisStandIn) Addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *redisStandIn) Keys() []string {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	var keys []string
+	for key := range r.data {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (r *redisStandIn) TTL(key string) time.Duration {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	return r.ttls[key]
+}
+
+func (r *redisStandIn) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			rd := bufio.NewReader(conn)
+			for {
+				args, err := readRedisCommand(rd)
+				if err != nil {
+					return
+				}
+				if _, err := conn.Write(r.reply(args)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func readRedisCommand(rd *bufio.Reader) ([]string, error) {
+	readLine := func(prefix byte) (int, error) {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		if len(line) < 3 || line[0] != prefix {
+			return 0, fmt.Errorf("unexpected line: %q", line)
+		}
+		return strconv.Atoi(strings.TrimSpace(line[1:]))
+	}
+
+	n, err := readLine('*')
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		size, err := readLine('$')
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+
+	return args, nil
+}
+
+func redisBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func redisArray(elems ...string) string {
+	return fmt.Sprintf("*%d\r\n", len(elems)) + strings.Join(elems, "")
+}
+
+func (r *redisStandIn) reply(args []string) []byte {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	switch strings.ToLower(args[0]) {
+	case "ping":
+		return []byte("+PONG\r\n")
+	case "command":
+		var infos []string
+		for _, name := range []string{"get", "set", "del", "expire", "pexpire", "scan", "ping"} {
+			first := ":1\r\n"
+			if name == "scan" || name == "ping" {
+				first = ":0\r\n"
+			}
+			infos = append(infos, redisArray(redisBulk(name), ":-2\r\n", redisArray(), first, first, ":1\r\n"))
+		}
+		return []byte(redisArray(infos...))
+	case "cluster":
+		if len(r.cluster) == 0 {
+			return []byte("-ERR This instance has cluster support disabled\r\n")
+		}
+		var slots []string
+		per := 16384 / len(r.cluster)
+		for i, addr := range r.cluster {
+			host, port, _ := net.SplitHostPort(addr)
+			end := (i+1)*per - 1
+			if i == len(r.cluster)-1 {
+				end = 16383
+			}
+			slots = append(slots, redisArray(fmt.Sprintf(":%d\r\n", i*per), fmt.Sprintf(":%d\r\n", end), redisArray(redisBulk(host), redisBulk(port))))
+		}
+		return []byte(redisArray(slots...))
+	case "get":
+		val, ok := r.data[args[1]]
+		if !ok {
+			return []byte("$-1\r\n")
+		}
+		return []byte(redisBulk(val))
+	case "set":
+		r.data[args[1]] = args[2]
+		r.ttls[args[1]] = 0
+		if len(args) == 5 {
+			n, _ := strconv.Atoi(args[4])
+			r.ttls[args[1]] = time.Duration(n) * time.Millisecond
+			if strings.ToLower(args[3]) == "ex" {
+				r.ttls[args[1]] = time.Duration(n) * time.Second
+			}
+		}
+		return []byte("+OK\r\n")
+	case "del":
+		_, ok := r.data[args[1]]
+		delete(r.data, args[1])
+		if ok {
+			return []byte(":1\r\n")
+		}
+		return []byte(":0\r\n")
+	case "expire", "pexpire":
+		if _, ok := r.data[args[1]]; !ok {
+			return []byte(":0\r\n")
+		}
+		n, _ := strconv.Atoi(args[2])
+		r.ttls[args[1]] = time.Duration(n) * time.Millisecond
+		if args[0] == "expire" {
+			r.ttls[args[1]] = time.Duration(n) * time.Second
+		}
+		return []byte(":1\r\n")
+	case "scan":
+		match := "*"
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToLower(args[i]) == "match" && args[i+1] != "" {
+				match = args[i+1]
+			}
+		}
+		var keys []string
+		for key := range r.data {
+			if ok, _ := path.Match(match, key); ok {
+				keys = append(keys, redisBulk(key))
+			}
+		}
+		return []byte(redisArray(redisBulk("0"), redisArray(keys...)))
+	}
+
+	return []byte("-ERR unknown command '" + args[0] + "'\r\n")
+}
+
+func TestRedisStorerUniversal(t *testing.T) {
+	t.Parallel()
+
+	node := newRedisStandIn(t)
+	storer, err := NewRedisStorerUniversal(redis.UniversalOptions{Addrs: []string{node.Addr()}}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storer.client.Close()
+
+	if _, ok := storer.client.(*redis.Client); !ok {
+		t.Errorf("expected a single address to create a client, got: %T", storer.client)
+	}
+
+	ctx := context.Background()
+	if err := storer.Set(ctx, "a", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := storer.Get(ctx, "a"); err != nil || val != "hello" {
+		t.Errorf("expected hello, got: %q %v", val, err)
+	}
+	if list, err := storer.All(ctx); err != nil || len(list) != 1 || list[0] != "a" {
+		t.Errorf("expected a, got: %v %v", list, err)
+	}
+}
+
+func TestRedisStorerCluster(t *testing.T) {
+	t.Parallel()
+
+	nodes := []*redisStandIn{newRedisStandIn(t), newRedisStandIn(t)}
+	addrs := []string{nodes[0].Addr(), nodes[1].Addr()}
+	for _, node := range nodes {
+		node.mut.Lock()
+		node.cluster = addrs
+		node.mut.Unlock()
+	}
+
+	storer, err := NewRedisStorerUniversal(redis.UniversalOptions{Addrs: addrs}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storer.client.Close()
+	storer.KeyPrefix = "session:"
+
+	if _, ok := storer.client.(*redis.ClusterClient); !ok {
+		t.Fatalf("expected several addresses to create a cluster client, got: %T", storer.client)
+	}
+
+	ctx := context.Background()
+	var want []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("id%d", i)
+		want = append(want, key)
+		if err := storer.Set(ctx, key, "val"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, node := range nodes {
+		if len(node.Keys()) == 0 {
+			t.Errorf("expected node %d to hold some of the sessions", i)
+		}
+	}
+
+	list, err := storer.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(list)
+	sort.Strings(want)
+	if strings.Join(list, ",") != strings.Join(want, ",") {
+		t.Errorf("expected every session from every master, got: %v", list)
+	}
+
+	if val, err := storer.Get(ctx, "id7"); err != nil || val != "val" {
+		t.Errorf("expected val, got: %q %v", val, err)
+	}
+	if err := storer.Del(ctx, "id7"); err != nil {
+		t.Error(err)
+	}
+	if _, err := storer.Get(ctx, "id7"); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+}
+
+func TestRedisStorerSetAndRefresh(t *testing.T) {
+	t.Parallel()
+
+	node := newRedisStandIn(t)
+	storer, err := NewRedisStorerClient(redis.NewClient(&redis.Options{Addr: node.Addr()}), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storer.client.Close()
+
+	ctx := context.Background()
+	if err := storer.ResetExpiry(ctx, "a"); !IsNoSessionError(err) {
+		t.Errorf("expected no session error resetting a missing key, got: %v", err)
+	}
+	if err := storer.ResetExpiryTTL(ctx, "a", time.Minute); !IsNoSessionError(err) {
+		t.Errorf("expected no session error resetting a missing key, got: %v", err)
+	}
+
+	if err := storer.SetAndRefresh(ctx, "a", "hello", 0); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := node.TTL("a"); ttl != time.Hour {
+		t.Errorf("expected the max age to be used, got: %v", ttl)
+	}
+	if err := storer.SetAndRefresh(ctx, "a", "hello", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := node.TTL("a"); ttl != time.Minute {
+		t.Errorf("expected the ttl to be used, got: %v", ttl)
+	}
+
+	if err := storer.ResetExpiry(ctx, "a"); err != nil {
+		t.Error(err)
+	}
+	if ttl := node.TTL("a"); ttl != time.Hour {
+		t.Errorf("expected the expiry to be reset to the max age, got: %v", ttl)
+	}
+}
+
+func TestRedisStorerCompareAndSetAndRefresh(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping long test")
+	}
+
+	storer, err := NewDefaultRedisStorer("", "", 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testidUUID, err := uuid.NewV4()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testid1 := testidUUID.String()
+	ctx := context.Background()
+
+	if err = storer.CompareAndSetAndRefresh(ctx, testid1, "hello", "", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := storer.client.TTL(ctx, testid1).Val(); ttl > time.Hour || ttl < 59*time.Minute {
+		t.Errorf("expected ttl to be an hour, got: %v", ttl)
+	}
+
+	if err = storer.CompareAndSetAndRefresh(ctx, testid1, "hi", "", time.Hour); !IsVersionConflictError(err) {
+		t.Errorf("expected a version conflict, got: %v", err)
+	}
+	if err = storer.CompareAndSetAndRefresh(ctx, testid1, "hi", valueVersion("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := storer.client.TTL(ctx, testid1).Val(); ttl <= time.Hour {
+		t.Errorf("expected ttl to be the max age, got: %v", ttl)
+	}
+
+	// Cleanup
+	storer.Del(ctx, testid1)
+}
@@ -3,6 +3,8 @@ package possessions
 import (
 	"bufio"
 	"context"
+	"io"
+	"log"
 	"net"
 	"net/http"
 
@@ -30,9 +32,19 @@ type possesionsWriter struct {
 	// of the request for cancellation/deadlines for things that occur
 	// when writing out sessions so it should be okay
 	ctx        context.Context
+	request    *http.Request
 	session    Session
 	hasWritten bool
-	events     []Event
+	// hijacked is set once the handler took over the connection, the
+	// client state can no longer be written after that
+	hijacked bool
+	events   []Event
+
+	// errorHandler is called when writing the client state fails
+	errorHandler ErrorHandler
+	// failure is set when writing the client state failed and the
+	// errorHandler took over the response
+	failure error
 }
 
 func newResponseWriter(ctx context.Context, w http.ResponseWriter, overseer Overseer, session Session) *possesionsWriter {
@@ -54,18 +66,76 @@ func (r *possesionsWriter) Header() http.Header {
 func (r *possesionsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	h, ok := r.underlying.(http.Hijacker)
 	if ok {
-		return h.Hijack()
+		conn, rw, err := h.Hijack()
+		if err == nil {
+			r.hijacked = true
+		}
+		return conn, rw, err
 	}
 	return nil, nil, errors.New("possessions: underlying ResponseWriter does not support hijacking")
 }
 
-// WriteHeader writes the header, but in order to handle errors from the
-// underlying ClientStateReadWriter, it has to panic.
+// Flush implements the http.Flusher interface by calling the underlying
+// implementation if available. The client state is written before the
+// first flush since the headers go out with it.
+func (r *possesionsWriter) Flush() {
+	_ = r.FlushError()
+}
+
+// FlushError flushes like Flush but reports failures, it is what
+// http.ResponseController uses. It returns http.ErrNotSupported when the
+// underlying writer cannot flush.
+func (r *possesionsWriter) FlushError() error {
+	if !r.commitClientState() {
+		return r.failure
+	}
+
+	switch f := r.underlying.(type) {
+	case interface{ FlushError() error }:
+		return f.FlushError()
+	case http.Flusher:
+		f.Flush()
+		return nil
+	}
+
+	return http.ErrNotSupported
+}
+
+// Push implements the http.Pusher interface by calling the underlying
+// implementation if available.
+func (r *possesionsWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := r.underlying.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// ReadFrom implements the io.ReaderFrom interface by calling the underlying
+// implementation if available so that sendfile and friends can be used. The
+// client state is written before anything is read.
+func (r *possesionsWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !r.commitClientState() {
+		return 0, r.failure
+	}
+
+	if rf, ok := r.underlying.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(r.underlying, src)
+}
+
+// Unwrap returns the underlying http.ResponseWriter, it allows
+// http.ResponseController to reach features of the real connection.
+func (r *possesionsWriter) Unwrap() http.ResponseWriter {
+	return r.underlying
+}
+
+// WriteHeader ensures that the client state is written before the header.
+// If writing the client state fails and the ErrorHandler writes its own
+// response the header is discarded.
 func (r *possesionsWriter) WriteHeader(code int) {
-	if !r.hasWritten {
-		if err := r.writeClientState(r.ctx); err != nil {
-			panic(err)
-		}
+	if !r.commitClientState() {
+		return
 	}
 	r.underlying.WriteHeader(code)
 }
@@ -73,10 +143,8 @@ func (r *possesionsWriter) WriteHeader(code int) {
 // Write ensures that the client state is written before any writes
 // to the body occur (before header flush to http client)
 func (r *possesionsWriter) Write(b []byte) (int, error) {
-	if !r.hasWritten {
-		if err := r.writeClientState(r.ctx); err != nil {
-			return 0, err
-		}
+	if !r.commitClientState() {
+		return 0, r.failure
 	}
 	return r.underlying.Write(b)
 }
@@ -95,29 +163,110 @@ func (r *possesionsWriter) writeClientState(ctx context.Context) error {
 	return nil
 }
 
+// commitClientState writes the client state if it has not been written yet.
+// It returns false if that failed and the ErrorHandler wrote a response in
+// place of the handler's.
+func (r *possesionsWriter) commitClientState() bool {
+	if r.hijacked {
+		return true
+	}
+
+	if r.hasWritten {
+		return r.failure == nil
+	}
+
+	err := r.writeClientState(r.ctx)
+	if err == nil {
+		return true
+	}
+
+	// Never try to write the client state twice
+	r.hasWritten = true
+
+	err = errWriteState{err: err}
+	handler := r.errorHandler
+	if handler == nil {
+		handler = DefaultErrorHandler
+	}
+	if handler(r.underlying, r.request, err) {
+		return true
+	}
+
+	r.failure = err
+	return false
+}
+
+// ErrorHandler is called when the overseer fails to read or write the
+// session state, IsReadStateError and IsWriteStateError tell the two apart.
+//
+// Returning true carries on with the request: after a failed read the
+// handler runs without a session and after a failed write the handler's
+// response is written as usual. Returning false means the ErrorHandler
+// wrote the response itself, after a failed read the handler is never
+// called and after a failed write anything the handler writes is discarded.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, err error) bool
+
+// DefaultErrorHandler logs the error to the http.Server's ErrorLog (or the
+// log package's standard logger when there is none) and responds with a 500
+// Internal Server Error
+func DefaultErrorHandler(w http.ResponseWriter, r *http.Request, err error) bool {
+	logf := log.Printf
+	if server, ok := r.Context().Value(http.ServerContextKey).(*http.Server); ok && server.ErrorLog != nil {
+		logf = server.ErrorLog.Printf
+	}
+	logf("possessions: %s %s: %v", r.Method, r.URL.Path, err)
+
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	return false
+}
+
+// MiddlewareOption configures an OverseeingMiddleware
+type MiddlewareOption func(*OverseeingMiddleware)
+
+// WithErrorHandler sets the ErrorHandler, by default (or when handler is nil)
+// DefaultErrorHandler is used.
+func WithErrorHandler(handler ErrorHandler) MiddlewareOption {
+	return func(o *OverseeingMiddleware) {
+		o.errorHandler = handler
+	}
+}
+
 // OverseeingMiddleware enables the use of sessions in this package by allowing
 // read and writes of client state during the request.
 type OverseeingMiddleware struct {
-	overseer Overseer
+	overseer     Overseer
+	errorHandler ErrorHandler
 }
 
 type oversight struct {
-	handler  http.Handler
-	overseer Overseer
+	handler      http.Handler
+	overseer     Overseer
+	errorHandler ErrorHandler
 }
 
 // NewOverseeingMiddleware constructs a middleware
-func NewOverseeingMiddleware(overseer Overseer) OverseeingMiddleware {
-	return OverseeingMiddleware{
-		overseer: overseer,
+func NewOverseeingMiddleware(overseer Overseer, opts ...MiddlewareOption) OverseeingMiddleware {
+	o := OverseeingMiddleware{
+		overseer:     overseer,
+		errorHandler: DefaultErrorHandler,
 	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.errorHandler == nil {
+		o.errorHandler = DefaultErrorHandler
+	}
+
+	return o
 }
 
 // Wrap a handler
 func (o OverseeingMiddleware) Wrap(h http.Handler) http.Handler {
 	return oversight{
-		handler:  h,
-		overseer: o.overseer,
+		handler:      h,
+		overseer:     o.overseer,
+		errorHandler: o.errorHandler,
 	}
 }
 
@@ -129,14 +278,24 @@ func (o oversight) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		session = nil
 		noSession = true
 	} else if err != nil {
-		panic(errors.Wrap(err, "failed to read session state"))
+		if !o.errorHandler(w, r, errReadState{err: err}) {
+			return
+		}
+		session = nil
 	}
 
 	ctx := context.WithValue(r.Context(), CTXKeyPossessions{}, session)
 	pw := newResponseWriter(ctx, w, o.overseer, session)
+	pw.errorHandler = o.errorHandler
 	if noSession {
 		pw.events = append(pw.events, Event{Kind: EventDelClientState})
 	}
 	r = r.WithContext(ctx)
+	pw.request = r
 	o.handler.ServeHTTP(pw, r)
+
+	// The handler never wrote a header or body (empty 200s, HEAD requests
+	// etc.) so the client state was never written, do it now before the
+	// http server sends the response.
+	pw.commitClientState()
 }
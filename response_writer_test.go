@@ -0,0 +1,558 @@
+package possessions
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// countingOverseer wraps an overseer and counts the calls to WriteState
+type countingOverseer struct {
+	Overseer
+	writes *int
+}
+
+func (c countingOverseer) WriteState(ctx context.Context, w http.ResponseWriter, sess Session, evs []Event) error {
+	*c.writes++
+	return c.Overseer.WriteState(ctx, w, sess, evs)
+}
+
+func TestOverseeingMiddlewareWritesWithoutBody(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name    string
+		Method  string
+		Handler http.HandlerFunc
+		Status  int
+	}{
+		{
+			Name:   "EmptyBody",
+			Method: "GET",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				Set(w, "key", "value")
+			},
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "Head",
+			Method: "HEAD",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				Set(w, "key", "value")
+				w.Header().Set("X-Test", "test")
+			},
+			Status: http.StatusOK,
+		},
+		{
+			Name:   "NoContent",
+			Method: "POST",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				Set(w, "key", "value")
+				w.WriteHeader(http.StatusNoContent)
+			},
+			Status: http.StatusNoContent,
+		},
+		{
+			Name:   "Body",
+			Method: "GET",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				Set(w, "key", "value")
+				w.Write([]byte("hello"))
+			},
+			Status: http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.Name, func(t *testing.T) {
+			t.Parallel()
+
+			m, err := NewDefaultMemoryStorer()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			writes := 0
+			overseer := countingOverseer{
+				Overseer: NewStorageOverseer(NewCookieOptions(), m),
+				writes:   &writes,
+			}
+			handler := NewOverseeingMiddleware(overseer).Wrap(test.Handler)
+
+			r := httptest.NewRequest(test.Method, "http://localhost", nil)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			if rec.Code != test.Status {
+				t.Errorf("expected status %d, got %d", test.Status, rec.Code)
+			}
+			if writes != 1 {
+				t.Errorf("expected session state to be written once, got %d", writes)
+			}
+
+			cookies := rec.Result().Cookies()
+			if len(cookies) != 1 {
+				t.Fatalf("expected 1 cookie, got %d", len(cookies))
+			}
+
+			val, err := m.Get(r.Context(), cookies[0].Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if val != `{"key":"value"}` {
+				t.Errorf("expected session to be stored, got: %s", val)
+			}
+		})
+	}
+}
+
+// failingOverseer fails to read and/or write session state
+type failingOverseer struct {
+	readErr  error
+	writeErr error
+}
+
+func (f failingOverseer) ReadState(*http.Request) (Session, error) {
+	return nil, f.readErr
+}
+
+func (f failingOverseer) WriteState(context.Context, http.ResponseWriter, Session, []Event) error {
+	return f.writeErr
+}
+
+func TestOverseeingMiddlewareReadError(t *testing.T) {
+	t.Parallel()
+
+	overseer := failingOverseer{readErr: errors.New("redis is down")}
+
+	called := false
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if _, ok := Get(r.Context(), "key"); ok {
+			t.Error("expected no session")
+		}
+	})
+
+	var handled error
+	errorHandler := func(w http.ResponseWriter, r *http.Request, err error) bool {
+		handled = err
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return false
+	}
+
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	NewOverseeingMiddleware(overseer, WithErrorHandler(errorHandler)).Wrap(handler).ServeHTTP(rec, r)
+
+	if !IsReadStateError(handled) || IsWriteStateError(handled) {
+		t.Errorf("expected a read state error, got: %v", handled)
+	}
+	if called {
+		t.Error("expected the handler not to be called")
+	}
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+
+	// Degrade to an anonymous session
+	errorHandler = func(w http.ResponseWriter, r *http.Request, err error) bool {
+		return true
+	}
+
+	rec = httptest.NewRecorder()
+	NewOverseeingMiddleware(overseer, WithErrorHandler(errorHandler)).Wrap(handler).ServeHTTP(rec, r)
+
+	if !called {
+		t.Error("expected the handler to be called")
+	}
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+}
+
+func TestOverseeingMiddlewareWriteError(t *testing.T) {
+	t.Parallel()
+
+	overseer := failingOverseer{writeErr: errors.New("redis is down")}
+
+	expectWriteErr := true
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Set(w, "key", "value")
+		w.WriteHeader(http.StatusCreated)
+		if _, err := w.Write([]byte("hello")); (err != nil) != expectWriteErr {
+			t.Errorf("expected write error to be %t, got: %v", expectWriteErr, err)
+		}
+	})
+
+	// The default handler renders a 500
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	NewOverseeingMiddleware(overseer).Wrap(handler).ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "hello") {
+		t.Error("expected the handler's body to be discarded")
+	}
+
+	// Log and continue
+	var handled error
+	errorHandler := func(w http.ResponseWriter, r *http.Request, err error) bool {
+		handled = err
+		return true
+	}
+
+	expectWriteErr = false
+	rec = httptest.NewRecorder()
+	NewOverseeingMiddleware(overseer, WithErrorHandler(errorHandler)).Wrap(handler).ServeHTTP(rec, r)
+
+	if !IsWriteStateError(handled) || IsReadStateError(handled) {
+		t.Errorf("expected a write state error, got: %v", handled)
+	}
+	if rec.Code != http.StatusCreated {
+		t.Errorf("expected status %d, got %d", http.StatusCreated, rec.Code)
+	}
+	if rec.Body.String() != "hello" {
+		t.Errorf("expected body to be written, got: %q", rec.Body.String())
+	}
+}
+
+func TestOverseeingMiddlewareNilErrorHandler(t *testing.T) {
+	t.Parallel()
+
+	called := false
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r = r.WithContext(context.WithValue(r.Context(), http.ServerContextKey, &http.Server{ErrorLog: log.New(ioutil.Discard, "", 0)}))
+	overseer := failingOverseer{readErr: errors.New("redis is down")}
+	NewOverseeingMiddleware(overseer, WithErrorHandler(nil)).Wrap(handler).ServeHTTP(rec, r)
+
+	if called {
+		t.Error("expected the handler not to be called")
+	}
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected the default error handler to respond with %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+}
+
+func TestOverseeingMiddlewareErrorCause(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name     string
+		Overseer failingOverseer
+		Is       func(error) bool
+	}{
+		{"ReadVersionConflict", failingOverseer{readErr: errVersionConflict{}}, IsVersionConflictError},
+		{"ReadPlain", failingOverseer{readErr: errors.New("redis is down")}, nil},
+		{"WriteCookieTooLarge", failingOverseer{writeErr: errCookieTooLarge{size: 20000, max: 15200}}, IsCookieTooLargeError},
+		{"WriteNoSession", failingOverseer{writeErr: errNoSession{}}, IsNoSessionError},
+		{"WriteVersionConflict", failingOverseer{writeErr: errVersionConflict{}}, IsVersionConflictError},
+		{"WriteNoMapKey", failingOverseer{writeErr: errNoMapKey{}}, IsNoMapKeyError},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.Name, func(t *testing.T) {
+			t.Parallel()
+
+			var handled error
+			errorHandler := func(w http.ResponseWriter, r *http.Request, err error) bool {
+				handled = err
+				return true
+			}
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				Set(w, "key", "value")
+			})
+
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "http://localhost", nil)
+			NewOverseeingMiddleware(test.Overseer, WithErrorHandler(errorHandler)).Wrap(handler).ServeHTTP(rec, r)
+
+			if handled == nil {
+				t.Fatal("expected the error handler to be called")
+			}
+			if test.Is == nil {
+				// A plain error matches none of the helpers
+				for _, is := range []func(error) bool{IsNoSessionError, IsNoMapKeyError, IsCookieTooLargeError, IsVersionConflictError} {
+					if is(handled) {
+						t.Errorf("expected %v not to match", handled)
+					}
+				}
+				return
+			}
+			if !test.Is(handled) {
+				t.Errorf("expected the cause of %v to be seen through the wrapper", handled)
+			}
+		})
+	}
+}
+
+// readerFromRecorder is a ResponseRecorder that implements io.ReaderFrom
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestResponseWriterOptionalInterfaces(t *testing.T) {
+	t.Parallel()
+
+	var w http.ResponseWriter = &possesionsWriter{}
+	if _, ok := w.(http.Flusher); !ok {
+		t.Error("expected http.Flusher to be implemented")
+	}
+	if _, ok := w.(interface{ FlushError() error }); !ok {
+		t.Error("expected FlushError to be implemented")
+	}
+	if _, ok := w.(http.Pusher); !ok {
+		t.Error("expected http.Pusher to be implemented")
+	}
+	if _, ok := w.(http.Hijacker); !ok {
+		t.Error("expected http.Hijacker to be implemented")
+	}
+	if _, ok := w.(io.ReaderFrom); !ok {
+		t.Error("expected io.ReaderFrom to be implemented")
+	}
+	if _, ok := w.(interface{ Unwrap() http.ResponseWriter }); !ok {
+		t.Error("expected Unwrap to be implemented")
+	}
+}
+
+func TestResponseWriterFlush(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Set(w, "key", "value")
+		w.(http.Flusher).Flush()
+
+		if !rec.Flushed {
+			t.Error("expected underlying writer to be flushed")
+		}
+		if rec.Header().Get("Set-Cookie") == "" {
+			t.Error("expected session cookie to be written before the flush")
+		}
+	})
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	NewOverseeingMiddleware(NewStorageOverseer(NewCookieOptions(), m)).Wrap(handler).ServeHTTP(rec, r)
+}
+
+// plainWriter is a ResponseWriter that implements none of the optional
+// interfaces
+type plainWriter struct {
+	http.ResponseWriter
+}
+
+// flushErrorWriter is a ResponseWriter whose FlushError fails
+type flushErrorWriter struct {
+	*httptest.ResponseRecorder
+	err error
+}
+
+func (f flushErrorWriter) FlushError() error {
+	return f.err
+}
+
+func TestResponseWriterFlushError(t *testing.T) {
+	t.Parallel()
+
+	flushErr := errors.New("connection reset")
+	tests := []struct {
+		Name string
+		W    http.ResponseWriter
+		Err  error
+	}{
+		{"Flusher", httptest.NewRecorder(), nil},
+		{"FlushError", flushErrorWriter{ResponseRecorder: httptest.NewRecorder(), err: flushErr}, flushErr},
+		{"Unsupported", plainWriter{ResponseWriter: httptest.NewRecorder()}, http.ErrNotSupported},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.Name, func(t *testing.T) {
+			t.Parallel()
+
+			m, err := NewDefaultMemoryStorer()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				Set(w, "key", "value")
+				if err := w.(interface{ FlushError() error }).FlushError(); err != test.Err {
+					t.Errorf("expected %v, got: %v", test.Err, err)
+				}
+				if w.Header().Get("Set-Cookie") == "" {
+					t.Error("expected session cookie to be written before the flush")
+				}
+			})
+
+			r := httptest.NewRequest("GET", "http://localhost", nil)
+			NewOverseeingMiddleware(NewStorageOverseer(NewCookieOptions(), m)).Wrap(handler).ServeHTTP(test.W, r)
+		})
+	}
+}
+
+func TestResponseWriterReadFrom(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Set(w, "key", "value")
+		if _, err := w.(io.ReaderFrom).ReadFrom(strings.NewReader("hello")); err != nil {
+			t.Error(err)
+		}
+	})
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	NewOverseeingMiddleware(NewStorageOverseer(NewCookieOptions(), m)).Wrap(handler).ServeHTTP(rec, r)
+
+	if !rec.readFrom {
+		t.Error("expected the underlying ReadFrom to be used")
+	}
+	if rec.Body.String() != "hello" {
+		t.Errorf("expected body to be hello, got: %q", rec.Body.String())
+	}
+	if rec.Header().Get("Set-Cookie") == "" {
+		t.Error("expected session cookie to be written")
+	}
+}
+
+func TestResponseWriterPushAndUnwrap(t *testing.T) {
+	t.Parallel()
+
+	rec := httptest.NewRecorder()
+	w := newResponseWriter(context.Background(), rec, nil, nil)
+
+	if err := w.Push("/style.css", nil); err != http.ErrNotSupported {
+		t.Errorf("expected push to be unsupported, got: %v", err)
+	}
+	if w.Unwrap() != rec {
+		t.Error("expected Unwrap to return the underlying writer")
+	}
+}
+
+func TestOverseeingMiddlewareHijack(t *testing.T) {
+	t.Parallel()
+
+	overseer := failingOverseer{writeErr: errors.New("redis is down")}
+
+	var handled error
+	errorHandler := func(w http.ResponseWriter, r *http.Request, err error) bool {
+		handled = err
+		return false
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Set(w, "key", "value")
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 5\r\nConnection: close\r\n\r\nhello")
+		rw.Flush()
+	})
+
+	done := make(chan struct{})
+	middleware := NewOverseeingMiddleware(overseer, WithErrorHandler(errorHandler)).Wrap(handler)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		middleware.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("expected the hijacked response, got: %d %q", resp.StatusCode, body)
+	}
+	// Wait for the middleware to finish after the handler returned
+	<-done
+	if handled != nil {
+		t.Errorf("expected no client state to be written after the hijack, got: %v", handled)
+	}
+}
+
+func TestDefaultErrorHandlerLogs(t *testing.T) {
+	t.Parallel()
+
+	var logged bytes.Buffer
+	var mut sync.Mutex
+	overseer := failingOverseer{readErr: errors.New("redis is down")}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	server := httptest.NewUnstartedServer(NewOverseeingMiddleware(overseer).Wrap(handler))
+	server.Config.ErrorLog = log.New(lockedWriter{w: &logged, mut: &mut}, "", 0)
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, resp.StatusCode)
+	}
+
+	mut.Lock()
+	defer mut.Unlock()
+	if !strings.Contains(logged.String(), "GET /path") || !strings.Contains(logged.String(), "redis is down") {
+		t.Errorf("expected the error to be logged to the server's ErrorLog, got: %q", logged.String())
+	}
+}
+
+// lockedWriter guards writes to w with mut
+type lockedWriter struct {
+	w   io.Writer
+	mut *sync.Mutex
+}
+
+func (l lockedWriter) Write(b []byte) (int, error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return l.w.Write(b)
+}
@@ -2,7 +2,10 @@ package possessions
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -17,14 +20,63 @@ type Session interface {
 // session holds the session value and the flash messages key/value mapping
 type session struct {
 	ID string
-	// value is the session value stored as a json encoded string
-	Values map[string]string
+	// Values holds the json encoded session values, strings set with Set
+	// are json strings and values set with SetAs are kept as they are
+	Values map[string]json.RawMessage
+
+	// stale is set when the client state must be rewritten even if the
+	// values did not change, for example when it was encrypted with a key
+	// that has since been rotated
+	stale bool
+	// chunks is the number of cookies the client state was split across
+	chunks int
+	// unhashed is set when the session was found in the Storer under its
+	// raw ID rather than the hash of it
+	unhashed bool
+	// version of the stored session when the Storer is a CASStorer
+	version string
+	// created is when the stored session was created, it is only tracked
+	// when the StorageOverseer has an AbsoluteLifetime
+	created time.Time
+	// unstamped is set when the stored session has no creation time yet
+	unstamped bool
+	// ttl is how long the session lives when it was set with SetTTL
+	ttl time.Duration
+	// refreshed is when the stored session was last refreshed
+	refreshed time.Time
 }
 
-// Get a key
+// Get a key, values that are not strings are returned json encoded
 func (s session) Get(key string) (string, bool) {
-	str, ok := s.Values[key]
-	return str, ok
+	raw, ok := s.Values[key]
+	if !ok {
+		return "", false
+	}
+
+	var str string
+	if len(raw) != 0 && raw[0] == '"' && json.Unmarshal(raw, &str) == nil {
+		return str, true
+	}
+
+	return string(raw), true
+}
+
+// getRaw returns the json encoded value of a key
+func (s session) getRaw(key string) (json.RawMessage, bool) {
+	raw, ok := s.Values[key]
+	return raw, ok
+}
+
+// rawSession is implemented by sessions that keep their values json encoded
+type rawSession interface {
+	getRaw(key string) (json.RawMessage, bool)
+}
+
+// rawString returns the json encoding of a string value
+func rawString(value string) json.RawMessage {
+	// Marshalling a string can not fail
+	raw, _ := json.Marshal(value)
+	return raw
 }
 
 // Storer provides methods to retrieve, add and delete sessions.
@@ -37,6 +89,57 @@ type Storer interface {
 	ResetExpiry(ctx context.Context, key string) error
 }
 
+// TTLStorer is a Storer that can expire sessions after a time-to-live chosen
+// per session rather than its own maxAge
+type TTLStorer interface {
+	Storer
+	// SetWithTTL saves the value so that it expires after ttl
+	SetWithTTL(ctx context.Context, key, value string, ttl time.Duration) error
+	// ResetExpiryTTL resets the expiry of the key to ttl from now
+	ResetExpiryTTL(ctx context.Context, key string, ttl time.Duration) error
+}
+
+// CASStorer is a Storer that supports optimistic concurrency control. When
+// the StorageOverseer's Storer implements it, concurrent requests changing
+// the same session no longer overwrite each other's changes.
+type CASStorer interface {
+	Storer
+	// GetVersion returns the value along with an opaque version of it
+	GetVersion(ctx context.Context, key string) (value, version string, err error)
+	// CompareAndSet saves the value only if the stored version still
+	// matches version, an empty version means the key must not exist.
+	// Use IsVersionConflictError to determine if the value was not saved
+	// because it was changed in the mean time.
+	CompareAndSet(ctx context.Context, key, value, version string) error
+}
+
+// RefreshStorer is a Storer that can store a session and reset its expiry
+// in a single operation. The StorageOverseer uses it for writes that also
+// refresh the session, saving a round trip to the store.
+type RefreshStorer interface {
+	Storer
+	// SetAndRefresh saves the value and resets its expiry to ttl from now,
+	// or to the Storer's maxAge when ttl is 0
+	SetAndRefresh(ctx context.Context, key, value string, ttl time.Duration) error
+}
+
+// CASRefreshStorer is a CASStorer that can also reset the expiry of a session
+// in the same operation that compares and sets it.
+type CASRefreshStorer interface {
+	CASStorer
+	// CompareAndSetAndRefresh behaves like CompareAndSet and resets the
+	// expiry of the key to ttl from now, or to the Storer's maxAge when ttl
+	// is 0
+	CompareAndSetAndRefresh(ctx context.Context, key, value, version string, ttl time.Duration) error
+}
+
+// valueVersion returns the version of a stored value used by the CASStorer
+// implementations in this package: the hex encoded sha1 of the value.
+func valueVersion(value string) string {
+	sum := sha1.Sum([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
 // EventKind of session mutation
 type EventKind int
 
@@ -53,6 +156,10 @@ const (
 	EventRefresh
 	// Deletes the client state
 	EventDelClientState
+	// EventRegenerate gives the session a new ID, keeping its values
+	EventRegenerate
+	// EventSetTTL sets how long the session lives to TTL
+	EventSetTTL
 )
 
 // Event represents an operation on a session
@@ -61,6 +168,14 @@ type Event struct {
 	Key  string
 	Val  string
 	Keys []string
+	TTL  time.Duration
+	// Refreshed is set on the EventRefresh of the throttled RefreshMiddleware,
+	// the StorageOverseer stores it with the session as the time it was last
+	// refreshed
+	Refreshed time.Time
+	// Raw is the json encoded value of an EventSet made by SetAs, it is
+	// used instead of Val when set
+	Raw json.RawMessage
 }
 
 // Overseer of session cookies
@@ -86,11 +201,39 @@ type noMapKeyInterface interface {
 	NoMapKey()
 }
 
+type cookieTooLargeInterface interface {
+	CookieTooLarge()
+}
+type versionConflictInterface interface {
+	VersionConflict()
+}
+type readStateInterface interface {
+	ReadStateFailed()
+}
+type writeStateInterface interface {
+	WriteStateFailed()
+}
+
 type errNoSession struct{}
 type errNoMapKey struct{}
+type errCookieTooLarge struct {
+	size int
+	max  int
+}
+type errVersionConflict struct{}
+type errReadState struct {
+	err error
+}
+type errWriteState struct {
+	err error
+}
 
-func (errNoSession) NoSession() {}
-func (errNoMapKey) NoMapKey()   {}
+func (errNoSession) NoSession()             {}
+func (errNoMapKey) NoMapKey()               {}
+func (errCookieTooLarge) CookieTooLarge()   {}
+func (errVersionConflict) VersionConflict() {}
+func (errReadState) ReadStateFailed()       {}
+func (errWriteState) WriteStateFailed()     {}
 
 func (errNoSession) Error() string {
 	return "session does not exist"
@@ -98,6 +241,40 @@ func (errNoSession) Error() string {
 func (errNoMapKey) Error() string {
 	return "session map key does not exist"
 }
+func (e errCookieTooLarge) Error() string {
+	return fmt.Sprintf("encoded session is %d bytes but cookies are limited to %d bytes", e.size, e.max)
+}
+func (errVersionConflict) Error() string {
+	return "session was changed concurrently"
+}
+func (e errReadState) Error() string {
+	return "failed to read session state: " + e.err.Error()
+}
+func (e errWriteState) Error() string {
+	return "failed to write session state: " + e.err.Error()
+}
+
+// Unwrap returns the error the overseer failed with
+func (e errReadState) Unwrap() error {
+	return e.err
+}
+
+// Cause returns the error the overseer failed with, it lets the Is*Error
+// helpers see through the wrapper
+func (e errReadState) Cause() error {
+	return e.err
+}
+
+// Unwrap returns the error the overseer failed with
+func (e errWriteState) Unwrap() error {
+	return e.err
+}
+
+// Cause returns the error the overseer failed with, it lets the Is*Error
+// helpers see through the wrapper
+func (e errWriteState) Cause() error {
+	return e.err
+}
 
 // IsNoSessionError checks an error to see if it means that there was no session
 func IsNoSessionError(err error) bool {
@@ -122,6 +299,54 @@ func IsNoMapKeyError(err error) bool {
 	return ok
 }
 
+// IsCookieTooLargeError checks an error to see if it means that the session
+// was too large to be stored in cookies
+func IsCookieTooLargeError(err error) bool {
+	_, ok := err.(cookieTooLargeInterface)
+	if ok {
+		return ok
+	}
+
+	_, ok = errors.Cause(err).(cookieTooLargeInterface)
+	return ok
+}
+
+// IsVersionConflictError checks an error to see if it means that a
+// CASStorer did not save a value because it was changed concurrently
+func IsVersionConflictError(err error) bool {
+	_, ok := err.(versionConflictInterface)
+	if ok {
+		return ok
+	}
+
+	_, ok = errors.Cause(err).(versionConflictInterface)
+	return ok
+}
+
+// IsReadStateError checks an error passed to an ErrorHandler to see if it
+// means that the overseer failed to read the session state
+func IsReadStateError(err error) bool {
+	_, ok := err.(readStateInterface)
+	if ok {
+		return ok
+	}
+
+	_, ok = errors.Cause(err).(readStateInterface)
+	return ok
+}
+
+// IsWriteStateError checks an error passed to an ErrorHandler to see if it
+// means that the overseer failed to write the session state
+func IsWriteStateError(err error) bool {
+	_, ok := err.(writeStateInterface)
+	if ok {
+		return ok
+	}
+
+	_, ok = errors.Cause(err).(writeStateInterface)
+	return ok
+}
+
 // timerTestHarness allows us to control the timer channels manually in the
 // disk and memory storer tests so that we can trigger cleans at will
 var timerTestHarness = func(d time.Duration) (timer, <-chan time.Time) {
@@ -188,11 +413,58 @@ func GetObj(ctx context.Context, key string, obj interface{}) error {
 	return nil
 }
 
+// GetAs decodes the session value into a T. Unlike GetObj the value is
+// not expected to be a json encoded string, which means values set with
+// SetAs keep their types, but values set with SetObj can be read as well.
+// Use IsNoMapKeyError to determine if the value was found or not.
+func GetAs[T any](ctx context.Context, key string) (T, error) {
+	var value T
+
+	raw, ok := getRaw(ctx, key)
+	if !ok {
+		return value, errNoMapKey{}
+	}
+
+	err := json.Unmarshal(raw, &value)
+	if err == nil {
+		return value, nil
+	}
+
+	// Values set with SetObj are json encoded into a string
+	var str string
+	if len(raw) != 0 && raw[0] == '"' && json.Unmarshal(raw, &str) == nil {
+		var objValue T
+		if json.Unmarshal([]byte(str), &objValue) == nil {
+			return objValue, nil
+		}
+	}
+
+	return value, errors.Wrap(err, "failed to unmarshal session key-value")
+}
+
 // Set a session-value string
 func Set(w http.ResponseWriter, key, value string) {
 	set(w, key, value)
 }
 
+// SetAs sets the session value to the json encoding of value, which is kept
+// as structured json in the session rather than a string, see GetAs
+func SetAs[T any](w http.ResponseWriter, key string, value T) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	pw := getResponseWriter(w)
+
+	pw.events = append(pw.events, Event{
+		Kind: EventSet,
+		Key:  key,
+		Raw:  raw,
+	})
+	return nil
+}
+
 // SetObj marshals the value to a json string and sets it in the session
 func SetObj(w http.ResponseWriter, key string, obj interface{}) error {
 	value, err := json.Marshal(obj)
@@ -218,6 +490,23 @@ func get(ctx context.Context, key string) (string, bool) {
 	return sess.Get(key)
 }
 
+func getRaw(ctx context.Context, key string) (json.RawMessage, bool) {
+	cached := ctx.Value(CTXKeyPossessions{})
+	if cached == nil {
+		return nil, false
+	}
+
+	if sess, ok := cached.(rawSession); ok {
+		return sess.getRaw(key)
+	}
+
+	value, ok := get(ctx, key)
+	if !ok {
+		return nil, false
+	}
+	return rawString(value), true
+}
+
 func set(w http.ResponseWriter, key, value string) {
 	pw := getResponseWriter(w)
 
@@ -257,6 +546,30 @@ func Refresh(w http.ResponseWriter) {
 	})
 }
 
+// Regenerate the session ID while keeping the session values. This should
+// be done whenever the privilege level of a session changes, for example
+// after logging in, to prevent session fixation attacks.
+func Regenerate(w http.ResponseWriter) {
+	pw := getResponseWriter(w)
+
+	pw.events = append(pw.events, Event{
+		Kind: EventRegenerate,
+	})
+}
+
+// SetTTL sets how long the session lives, for example to keep "remember me"
+// sessions around longer than others. The StorageOverseer applies it to the
+// session cookie's MaxAge and, if the Storer is a TTLStorer, to the stored
+// session. The TTL is kept for later refreshes.
+func SetTTL(w http.ResponseWriter, ttl time.Duration) {
+	pw := getResponseWriter(w)
+
+	pw.events = append(pw.events, Event{
+		Kind: EventSetTTL,
+		TTL:  ttl,
+	})
+}
+
 // AddFlash adds a flash message to the session. Typically read and removed
 // on the next request.
 func AddFlash(w http.ResponseWriter, key string, value string) {
@@ -2,7 +2,12 @@ package possessions
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSetAndSetObjAndDelAndDelAllAndRefreshAndFlashAndFlashObj(t *testing.T) {
@@ -52,11 +57,11 @@ func TestGetAndGetObjAndGetFlashAndGetFlashObj(t *testing.T) {
 
 	sess := session{
 		ID: uuid,
-		Values: map[string]string{
-			"key1":       "value1",
-			"key2":       `"value2"`,
-			"flash_key3": "value3",
-			"flash_key4": `"value4"`,
+		Values: map[string]json.RawMessage{
+			"key1":       rawString("value1"),
+			"key2":       rawString(`"value2"`),
+			"flash_key3": rawString("value3"),
+			"flash_key4": rawString(`"value4"`),
 		},
 	}
 	ctx := context.WithValue(context.Background(), CTXKeyPossessions{}, sess)
@@ -98,3 +103,110 @@ func TestGetAndGetObjAndGetFlashAndGetFlashObj(t *testing.T) {
 		t.Error("expected event set, flash_key4, value4", w.events[1])
 	}
 }
+
+func TestRegenerate(t *testing.T) {
+	t.Parallel()
+
+	w := newResponseWriter(context.Background(), nil, nil, nil)
+
+	Regenerate(w)
+
+	if len(w.events) != 1 {
+		t.Error("expected 1 event, got:", len(w.events))
+	}
+	if w.events[0].Kind != EventRegenerate {
+		t.Error("expected event regenerate", w.events[0])
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	t.Parallel()
+
+	w := newResponseWriter(context.Background(), nil, nil, nil)
+
+	SetTTL(w, time.Hour)
+
+	if len(w.events) != 1 {
+		t.Error("expected 1 event, got:", len(w.events))
+	}
+	if w.events[0].Kind != EventSetTTL || w.events[0].TTL != time.Hour {
+		t.Error("expected event set ttl of an hour", w.events[0])
+	}
+}
+
+func TestSetAsAndGetAs(t *testing.T) {
+	t.Parallel()
+
+	type cart struct {
+		Items []string `json:"items"`
+		Total int      `json:"total"`
+		Paid  bool     `json:"paid"`
+	}
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	overseer := NewStorageOverseer(NewCookieOptions(), m)
+
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	NewOverseeingMiddleware(overseer).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := SetAs(w, "cart", cart{Items: []string{"a", "b"}, Total: 5}); err != nil {
+			t.Error(err)
+		}
+		if err := SetAs(w, "count", 3); err != nil {
+			t.Error(err)
+		}
+		if err := SetObj(w, "obj", cart{Total: 1}); err != nil {
+			t.Error(err)
+		}
+		Set(w, "str", "hello")
+	})).ServeHTTP(rec, r)
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie, got %d", len(cookies))
+	}
+	stored, err := m.Get(r.Context(), cookies[0].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stored, `"cart":{"items":["a","b"],"total":5,"paid":false}`) || !strings.Contains(stored, `"count":3`) {
+		t.Errorf("expected typed values to be stored as json, got: %s", stored)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	NewOverseeingMiddleware(overseer).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := GetAs[cart](r.Context(), "cart")
+		if err != nil {
+			t.Error(err)
+		}
+		if len(c.Items) != 2 || c.Total != 5 || c.Paid {
+			t.Errorf("expected cart to round trip, got: %#v", c)
+		}
+
+		if count, err := GetAs[int](r.Context(), "count"); err != nil || count != 3 {
+			t.Errorf("expected count to be 3, got: %d %v", count, err)
+		}
+		if val, ok := Get(r.Context(), "count"); !ok || val != "3" {
+			t.Errorf("expected Get to return the json encoded value, got: %q", val)
+		}
+
+		// Values set with SetObj and Set can be read as well
+		if obj, err := GetAs[cart](r.Context(), "obj"); err != nil || obj.Total != 1 {
+			t.Errorf("expected obj to be read, got: %#v %v", obj, err)
+		}
+		if str, err := GetAs[string](r.Context(), "str"); err != nil || str != "hello" {
+			t.Errorf("expected str to be hello, got: %q %v", str, err)
+		}
+
+		if _, err := GetAs[int](r.Context(), "str"); err == nil {
+			t.Error("expected an error decoding a string into an int")
+		}
+		if _, err := GetAs[int](r.Context(), "missing"); !IsNoMapKeyError(err) {
+			t.Errorf("expected no map key error, got: %v", err)
+		}
+	})).ServeHTTP(httptest.NewRecorder(), r)
+}
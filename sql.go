@@ -0,0 +1,320 @@
+package possessions
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SQLDialect provides the SQL that differs between databases to the SQLStorer
+type SQLDialect interface {
+	// Placeholder returns the placeholder for the nth (starting at 1)
+	// argument of a statement
+	Placeholder(n int) string
+	// Upsert returns a statement inserting the id, value and expires_at
+	// columns into the table, or updating value and expires_at if the id
+	// already exists
+	Upsert(table string) string
+	// Schema returns the statements creating the table if it does not exist
+	Schema(table string) []string
+}
+
+// PostgresDialect is the SQLDialect for PostgreSQL
+type PostgresDialect struct{}
+
+// Placeholder returns $n
+func (PostgresDialect) Placeholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+// Upsert uses ON CONFLICT
+func (PostgresDialect) Upsert(table string) string {
+	return "INSERT INTO " + table + " (id, value, expires_at) VALUES ($1, $2, $3) " +
+		"ON CONFLICT (id) DO UPDATE SET value = EXCLUDED.value, expires_at = EXCLUDED.expires_at"
+}
+
+// Schema of the sessions table
+func (PostgresDialect) Schema(table string) []string {
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + table + " (id VARCHAR(255) PRIMARY KEY, value BYTEA NOT NULL, expires_at BIGINT)",
+		"CREATE INDEX IF NOT EXISTS " + table + "_expires_at_idx ON " + table + " (expires_at)",
+	}
+}
+
+// MySQLDialect is the SQLDialect for MySQL and MariaDB
+type MySQLDialect struct{}
+
+// Placeholder returns ?
+func (MySQLDialect) Placeholder(n int) string {
+	return "?"
+}
+
+// Upsert uses ON DUPLICATE KEY UPDATE
+func (MySQLDialect) Upsert(table string) string {
+	return "INSERT INTO " + table + " (id, value, expires_at) VALUES (?, ?, ?) " +
+		"ON DUPLICATE KEY UPDATE value = VALUES(value), expires_at = VALUES(expires_at)"
+}
+
+// Schema of the sessions table
+func (MySQLDialect) Schema(table string) []string {
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + table + " (id VARCHAR(255) PRIMARY KEY, value LONGBLOB NOT NULL, expires_at BIGINT, INDEX (expires_at))",
+	}
+}
+
+// SQLiteDialect is the SQLDialect for SQLite 3.24 and later
+type SQLiteDialect struct{}
+
+// Placeholder returns ?
+func (SQLiteDialect) Placeholder(n int) string {
+	return "?"
+}
+
+// Upsert uses ON CONFLICT
+func (SQLiteDialect) Upsert(table string) string {
+	return "INSERT INTO " + table + " (id, value, expires_at) VALUES (?, ?, ?) " +
+		"ON CONFLICT (id) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at"
+}
+
+// Schema of the sessions table
+func (SQLiteDialect) Schema(table string) []string {
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + table + " (id TEXT PRIMARY KEY, value BLOB NOT NULL, expires_at INTEGER)",
+		"CREATE INDEX IF NOT EXISTS " + table + "_expires_at_idx ON " + table + " (expires_at)",
+	}
+}
+
+// SQLStorer is a session storer implementation for saving sessions
+// to a SQL database using database/sql.
+//
+// Sessions are kept in a table with the columns id, value and expires_at,
+// see CreateTable. expires_at holds unix seconds and is NULL for sessions
+// that never expire.
+type SQLStorer struct {
+	db      *sql.DB
+	dialect SQLDialect
+	// table is the name of the sessions table, it is put into the SQL
+	// as is and must not come from user input
+	table string
+	// How long sessions take to expire in the database
+	maxAge time.Duration
+	// How often the database should be polled for expired sessions
+	cleanInterval time.Duration
+	// wg is used to manage the cleaner go routine
+	wg sync.WaitGroup
+	// quit channel for exiting the cleaner loop
+	quit chan struct{}
+}
+
+// NewDefaultSQLStorer returns a SQLStorer object with default values.
+// The default values are:
+// table: sessions
+// maxAge: 2 days (clear session stored in the database after 2 days)
+// cleanInterval: 1 hour (delete sessions older than maxAge every hour)
+func NewDefaultSQLStorer(db *sql.DB, dialect SQLDialect) (*SQLStorer, error) {
+	return NewSQLStorer(db, dialect, "sessions", time.Hour*24*2, time.Hour)
+}
+
+// NewSQLStorer initializes and returns a new SQLStorer object.
+// It takes the name of the sessions table, the maxAge of how long each
+// session should live in the database, and a cleanInterval duration which
+// defines how often the clean task should delete expired sessions.
+// Persistent storage can be attained by setting maxAge and cleanInterval
+// to zero.
+func NewSQLStorer(db *sql.DB, dialect SQLDialect, table string, maxAge, cleanInterval time.Duration) (*SQLStorer, error) {
+	if (maxAge != 0 && cleanInterval == 0) || (cleanInterval != 0 && maxAge == 0) {
+		panic("if max age or clean interval is set, the other must also be set")
+	}
+
+	s := &SQLStorer{
+		db:            db,
+		dialect:       dialect,
+		table:         table,
+		maxAge:        maxAge,
+		cleanInterval: cleanInterval,
+	}
+
+	return s, nil
+}
+
+// CreateTable creates the sessions table if it does not exist
+func (s *SQLStorer) CreateTable(ctx context.Context) error {
+	for _, stmt := range s.dialect.Schema(s.table) {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return errors.Wrap(err, "unable to create sessions table")
+		}
+	}
+
+	return nil
+}
+
+// All keys in the database
+func (s *SQLStorer) All(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id FROM "+s.table)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query sessions")
+	}
+	defer rows.Close()
+
+	var sessions []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, errors.Wrap(err, "unable to scan session id")
+		}
+		sessions = append(sessions, id)
+	}
+
+	return sessions, errors.Wrap(rows.Err(), "unable to iterate sessions")
+}
+
+// Get returns the value string saved in the session pointed to by the
+// session id key.
+func (s *SQLStorer) Get(ctx context.Context, key string) (value string, err error) {
+	query := "SELECT value FROM " + s.table + " WHERE id = " + s.dialect.Placeholder(1) +
+		" AND (expires_at IS NULL OR expires_at > " + s.dialect.Placeholder(2) + ")"
+
+	var val []byte
+	err = s.db.QueryRowContext(ctx, query, key, time.Now().Unix()).Scan(&val)
+	if err == sql.ErrNoRows {
+		return "", errNoSession{}
+	} else if err != nil {
+		return "", errors.Wrap(err, "unable to get session")
+	}
+
+	return string(val), nil
+}
+
+// Set saves the value string to the session pointed to by the session id key.
+func (s *SQLStorer) Set(ctx context.Context, key, value string) error {
+	return s.SetWithTTL(ctx, key, value, s.maxAge)
+}
+
+// SetWithTTL saves the value string to the session pointed to by the session
+// id key so that it expires after ttl instead of maxAge.
+func (s *SQLStorer) SetWithTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.Upsert(s.table), key, []byte(value), expiresAt(ttl))
+	return errors.Wrap(err, "unable to set session")
+}
+
+// SetAndRefresh saves the value string to the session pointed to by the
+// session id key and resets its expiry to ttl (or maxAge when ttl is 0), the
+// upsert sets both in one statement.
+func (s *SQLStorer) SetAndRefresh(ctx context.Context, key, value string, ttl time.Duration) error {
+	if ttl == 0 {
+		ttl = s.maxAge
+	}
+
+	return s.SetWithTTL(ctx, key, value, ttl)
+}
+
+// Del the session pointed to by the session id key and remove it.
+func (s *SQLStorer) Del(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM "+s.table+" WHERE id = "+s.dialect.Placeholder(1), key)
+	return errors.Wrap(err, "unable to delete session")
+}
+
+// ResetExpiry resets the expiry of the key
+func (s *SQLStorer) ResetExpiry(ctx context.Context, key string) error {
+	return s.ResetExpiryTTL(ctx, key, s.maxAge)
+}
+
+// ResetExpiryTTL resets the expiry of the key to ttl from now, it returns
+// errNoSession if the key does not exist or has expired
+func (s *SQLStorer) ResetExpiryTTL(ctx context.Context, key string, ttl time.Duration) error {
+	now := time.Now().Unix()
+	query := "UPDATE " + s.table + " SET expires_at = " + s.dialect.Placeholder(1) +
+		" WHERE id = " + s.dialect.Placeholder(2) +
+		" AND (expires_at IS NULL OR expires_at > " + s.dialect.Placeholder(3) + ")"
+
+	result, err := s.db.ExecContext(ctx, query, expiresAt(ttl), key, now)
+	if err != nil {
+		return errors.Wrap(err, "unable to reset session expiry")
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		return nil
+	}
+
+	// Some databases (MySQL) count the rows that were changed rather than
+	// matched, so an expiry that was already set to the same second looks
+	// like a missing session. Check whether it is there.
+	query = "SELECT 1 FROM " + s.table + " WHERE id = " + s.dialect.Placeholder(1) +
+		" AND (expires_at IS NULL OR expires_at > " + s.dialect.Placeholder(2) + ")"
+
+	var exists int
+	err = s.db.QueryRowContext(ctx, query, key, now).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return errNoSession{}
+	} else if err != nil {
+		return errors.Wrap(err, "unable to reset session expiry")
+	}
+
+	return nil
+}
+
+// expiresAt returns the expires_at column value for a session living for
+// ttl, sessions with no ttl never expire
+func expiresAt(ttl time.Duration) interface{} {
+	if ttl == 0 {
+		return nil
+	}
+
+	return time.Now().Add(ttl).Unix()
+}
+
+// Clean deletes all sessions in the database that have expired
+func (s *SQLStorer) Clean() error {
+	query := "DELETE FROM " + s.table + " WHERE expires_at IS NOT NULL AND expires_at <= " + s.dialect.Placeholder(1)
+
+	_, err := s.db.Exec(query, time.Now().Unix())
+	return errors.Wrap(err, "unable to delete expired sessions")
+}
+
+// StartCleaner starts the database session cleaner go routine. This go
+// routine will delete expired sessions from the database on the
+// cleanInterval interval.
+func (s *SQLStorer) StartCleaner() {
+	if s.maxAge == 0 || s.cleanInterval == 0 {
+		panic("both max age and clean interval must be set to non-zero")
+	}
+
+	// init quit chan
+	s.quit = make(chan struct{})
+
+	s.wg.Add(1)
+
+	// Start the cleaner infinite loop go routine.
+	// StopCleaner() can be used to kill this go routine.
+	go s.cleanerLoop()
+}
+
+// StopCleaner stops the cleaner go routine
+func (s *SQLStorer) StopCleaner() {
+	close(s.quit)
+	s.wg.Wait()
+}
+
+// cleanerLoop executes the Clean() method every time cleanInterval elapses.
+// StopCleaner() can be used to kill this go routine loop.
+func (s *SQLStorer) cleanerLoop() {
+	defer s.wg.Done()
+
+	t, c := timerTestHarness(s.cleanInterval)
+
+	for {
+		select {
+		case <-c:
+			// A failed clean is retried on the next interval
+			_ = s.Clean()
+			t.Reset(s.cleanInterval)
+		case <-s.quit:
+			t.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package possessions
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSQLDriver is a database/sql driver that understands only the
+// statements the SQLStorer uses, keeping a table per data source name
+type fakeSQLDriver struct {
+	mut    sync.Mutex
+	tables map[string]map[string]fakeSQLRow
+}
+
+type fakeSQLRow struct {
+	value   []byte
+	expires interface{}
+}
+
+var fakeSQL = &fakeSQLDriver{tables: make(map[string]map[string]fakeSQLRow)}
+
+func init() {
+	sql.Register("possessionsfake", fakeSQL)
+}
+
+func (f *fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if f.tables[name] == nil {
+		f.tables[name] = make(map[string]fakeSQLRow)
+	}
+	return fakeSQLConn{driver: f, name: name}, nil
+}
+
+type fakeSQLConn struct {
+	driver *fakeSQLDriver
+	name   string
+}
+
+func (c fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeSQLStmt{conn: c, query: query}, nil
+}
+func (c fakeSQLConn) Close() error              { return nil }
+func (c fakeSQLConn) Begin() (driver.Tx, error) { return nil, fmt.Errorf("transactions not supported") }
+
+type fakeSQLStmt struct {
+	conn  fakeSQLConn
+	query string
+}
+
+func (s fakeSQLStmt) Close() error  { return nil }
+func (s fakeSQLStmt) NumInput() int { return -1 }
+
+func (s fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	f := s.conn.driver
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	table := f.tables[s.conn.name]
+
+	switch {
+	case strings.HasPrefix(s.query, "CREATE"):
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(s.query, "INSERT"):
+		table[args[0].(string)] = fakeSQLRow{value: args[1].([]byte), expires: args[2]}
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "UPDATE"):
+		row, ok := table[args[1].(string)]
+		if !ok || !fakeSQLLive(row, args[2]) {
+			return driver.RowsAffected(0), nil
+		}
+		// Like MySQL only rows that were changed are counted
+		if row.expires == args[0] {
+			return driver.RowsAffected(0), nil
+		}
+		row.expires = args[0]
+		table[args[1].(string)] = row
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "DELETE") && strings.Contains(s.query, "expires_at"):
+		var n int64
+		for id, row := range table {
+			if row.expires != nil && row.expires.(int64) <= args[0].(int64) {
+				delete(table, id)
+				n++
+			}
+		}
+		return driver.RowsAffected(n), nil
+	case strings.HasPrefix(s.query, "DELETE"):
+		delete(table, args[0].(string))
+		return driver.RowsAffected(1), nil
+	}
+
+	return nil, fmt.Errorf("unexpected exec: %s", s.query)
+}
+
+func (s fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	f := s.conn.driver
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	table := f.tables[s.conn.name]
+
+	rows := &fakeSQLRows{}
+	switch {
+	case strings.HasPrefix(s.query, "SELECT id"):
+		rows.column = "id"
+		for id := range table {
+			rows.values = append(rows.values, id)
+		}
+	case strings.HasPrefix(s.query, "SELECT value"):
+		rows.column = "value"
+		row, ok := table[args[0].(string)]
+		if ok && fakeSQLLive(row, args[1]) {
+			rows.values = append(rows.values, row.value)
+		}
+	case strings.HasPrefix(s.query, "SELECT 1"):
+		rows.column = "1"
+		row, ok := table[args[0].(string)]
+		if ok && fakeSQLLive(row, args[1]) {
+			rows.values = append(rows.values, int64(1))
+		}
+	default:
+		return nil, fmt.Errorf("unexpected query: %s", s.query)
+	}
+
+	return rows, nil
+}
+
+// fakeSQLLive returns true if the row has not expired at now
+func fakeSQLLive(row fakeSQLRow, now driver.Value) bool {
+	return row.expires == nil || row.expires.(int64) > now.(int64)
+}
+
+type fakeSQLRows struct {
+	column string
+	values []driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string { return []string{r.column} }
+func (r *fakeSQLRows) Close() error      { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0], r.values = r.values[0], r.values[1:]
+	return nil
+}
+
+func newTestSQLStorer(t *testing.T, name string, maxAge, cleanInterval time.Duration) *SQLStorer {
+	db, err := sql.Open("possessionsfake", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSQLStorer(db, SQLiteDialect{}, "sessions", maxAge, cleanInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateTable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestSQLStorerNewDefault(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewDefaultSQLStorer(nil, PostgresDialect{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.table != "sessions" {
+		t.Error("expected table to be sessions, got", s.table)
+	}
+	if s.maxAge != time.Hour*24*2 {
+		t.Error("expected max age to be 2 days")
+	}
+	if s.cleanInterval != time.Hour {
+		t.Error("expected clean interval to be 1 hour")
+	}
+}
+
+func TestSQLDialects(t *testing.T) {
+	t.Parallel()
+
+	if p := (PostgresDialect{}).Placeholder(2); p != "$2" {
+		t.Errorf("expected $2, got %s", p)
+	}
+	if p := (MySQLDialect{}).Placeholder(2); p != "?" {
+		t.Errorf("expected ?, got %s", p)
+	}
+
+	if q := (MySQLDialect{}).Upsert("s"); !strings.Contains(q, "ON DUPLICATE KEY UPDATE") {
+		t.Errorf("expected mysql upsert, got %s", q)
+	}
+	for _, d := range []SQLDialect{PostgresDialect{}, SQLiteDialect{}} {
+		if q := d.Upsert("s"); !strings.HasPrefix(q, "INSERT INTO s ") || !strings.Contains(q, "ON CONFLICT (id)") {
+			t.Errorf("expected upsert into s, got %s", q)
+		}
+	}
+
+	for _, d := range []SQLDialect{PostgresDialect{}, MySQLDialect{}, SQLiteDialect{}} {
+		schema := d.Schema("s")
+		if len(schema) == 0 || !strings.HasPrefix(schema[0], "CREATE TABLE IF NOT EXISTS s ") || !strings.Contains(schema[0], "expires_at") {
+			t.Errorf("expected schema for s, got %v", schema)
+		}
+	}
+}
+
+func TestSQLStorer(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := newTestSQLStorer(t, "crud", time.Hour, time.Hour)
+
+	if _, err := s.Get(ctx, "a"); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+	if err := s.ResetExpiry(ctx, "a"); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+
+	if err := s.Set(ctx, "a", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(ctx, "b", "world"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(ctx, "a", "hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	if val, err := s.Get(ctx, "a"); err != nil || val != "hi" {
+		t.Errorf("expected hi, got: %q %v", val, err)
+	}
+
+	keys, err := s.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("expected keys a and b, got: %v", keys)
+	}
+
+	if err := s.ResetExpiry(ctx, "a"); err != nil {
+		t.Error(err)
+	}
+	// Resetting to the expiry it already has changes no rows
+	if err := s.ResetExpiry(ctx, "a"); err != nil {
+		t.Errorf("expected an unchanged expiry not to be a missing session, got: %v", err)
+	}
+
+	if err := s.SetAndRefresh(ctx, "b", "again", 0); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := s.Get(ctx, "b"); err != nil || val != "again" {
+		t.Errorf("expected again, got: %q %v", val, err)
+	}
+
+	if err := s.Del(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "a"); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+}
+
+func TestSQLStorerTTL(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := newTestSQLStorer(t, "ttl", 0, 0)
+
+	if err := s.Set(ctx, "forever", "val"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetWithTTL(ctx, "expired", "val", -time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get(ctx, "forever"); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.Get(ctx, "expired"); !IsNoSessionError(err) {
+		t.Errorf("expected expired session to be gone, got: %v", err)
+	}
+
+	// Expired sessions that were not cleaned yet are gone for good
+	if err := s.ResetExpiryTTL(ctx, "expired", time.Hour); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+	if _, err := s.Get(ctx, "expired"); !IsNoSessionError(err) {
+		t.Errorf("expected expired session to stay gone, got: %v", err)
+	}
+
+	if err := s.ResetExpiryTTL(ctx, "forever", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "forever"); err != nil {
+		t.Errorf("expected session to be there after resetting its expiry, got: %v", err)
+	}
+}
+
+func TestSQLStorerCleaner(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLStorer(t, "cleaner", time.Hour, time.Hour)
+
+	tm := memoryTestTimer{}
+	ch := make(chan time.Time)
+	timerTestHarness = func(d time.Duration) (timer, <-chan time.Time) {
+		return tm, ch
+	}
+
+	if err := s.Set(ctx, "testid1", "test1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetWithTTL(ctx, "testid2", "test2", -time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start the cleaner go routine
+	s.StartCleaner()
+
+	// Signal the timer channel to execute the clean
+	ch <- time.Time{}
+
+	// Stop the cleaner, this will block until the cleaner has finished its operations
+	s.StopCleaner()
+
+	keys, err := s.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "testid1" {
+		t.Errorf("expected only testid1 to be left, got: %v", keys)
+	}
+}
@@ -1,17 +1,60 @@
 package possessions
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
+	"strings"
+	"time"
 
-	"github.com/gofrs/uuid"
 	"github.com/pkg/errors"
 )
 
+// casRetries is how many times the StorageOverseer re-reads a session and
+// replays the events when a CASStorer reports a version conflict
+const casRetries = 5
+
 // StorageOverseer holds cookie related variables and a session storer
 type StorageOverseer struct {
-	Storer  Storer
+	Storer Storer
+	// IDGenerator creates new session IDs and validates the ones read from
+	// cookies, it defaults to UUIDGenerator.
+	IDGenerator IDGenerator
+	// SigningKeys enables signing the session ID in the cookie with
+	// HMAC-SHA256 so that forged IDs are rejected without asking the Storer.
+	// The first key signs and every key verifies, cookies signed with any
+	// other than the first are re-signed the next time state is written.
+	SigningKeys [][]byte
+	// HashKey enables storing sessions in the Storer under an HMAC-SHA256
+	// of the session ID instead of the ID itself, so a leaked copy of the
+	// store does not contain any usable session IDs.
+	HashKey []byte
+	// MigrateUnhashedKeys makes ReadState fall back to looking up the raw
+	// session ID when nothing is stored under its hash. Sessions found this
+	// way are moved under the hash the next time state is written. This
+	// is only useful with HashKey, while existing sessions are migrated.
+	MigrateUnhashedKeys bool
+	// AbsoluteLifetime caps how long a session lives after it was created
+	// (or regenerated) no matter how often it is refreshed. Expired
+	// sessions are deleted when they are read. Sessions stored before it
+	// was set start their lifetime the first time they are read.
+	AbsoluteLifetime time.Duration
+	// Codec serializes the sessions kept in the Storer, it defaults to
+	// JSONCodec. Sessions written by the built in codecs and Codecs can
+	// always be read, so the Codec can be changed without losing sessions.
+	Codec Codec
+	// Codecs are additional codecs sessions may have been written with
+	Codecs []Codec
+	// CompressThreshold enables compressing serialized sessions larger than
+	// it (in bytes) with flate. Compressed sessions can always be read, even
+	// once it is set back to 0.
+	CompressThreshold int
+
 	options CookieOptions
 }
 
@@ -22,14 +65,16 @@ func NewStorageOverseer(opts CookieOptions, storer Storer) *StorageOverseer {
 	}
 
 	return &StorageOverseer{
-		Storer:  storer,
-		options: opts,
+		Storer:      storer,
+		IDGenerator: UUIDGenerator{},
+		Codec:       JSONCodec{},
+		options:     opts,
 	}
 }
 
 // ReadState from the request
 func (s StorageOverseer) ReadState(r *http.Request) (Session, error) {
-	id, err := s.options.getCookieValue(r)
+	value, err := s.options.getCookieValue(r)
 	if err != nil {
 		if IsNoSessionError(err) {
 			return nil, nil
@@ -37,33 +82,161 @@ func (s StorageOverseer) ReadState(r *http.Request) (Session, error) {
 		return nil, err
 	}
 
-	if !validKey(id) {
+	id, stale, ok := s.verifyID(value)
+	if !ok || !s.IDGenerator.Validate(id) {
 		return nil, errNoSession{}
 	}
 
-	encodedSession, err := s.Storer.Get(r.Context(), id)
+	key := s.storageKey(id)
+	unhashed := false
+	encodedSession, version, err := s.get(r.Context(), key)
+	if IsNoSessionError(err) && len(s.HashKey) != 0 && s.MigrateUnhashedKeys {
+		key = id
+		unhashed = true
+		encodedSession, version, err = s.get(r.Context(), key)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	sessValues := make(map[string]string)
-	if err = json.Unmarshal([]byte(encodedSession), &sessValues); err != nil {
+	sessionObj := session{
+		ID:       id,
+		stale:    stale,
+		unhashed: unhashed,
+		version:  version,
+	}
+	if err = decodeRecord(encodedSession, &sessionObj, s.codecs()...); err != nil {
 		return nil, err
 	}
 
-	return session{
-		ID:     id,
-		Values: sessValues,
-	}, nil
+	if s.AbsoluteLifetime != 0 {
+		if sessionObj.created.IsZero() {
+			sessionObj.created = time.Now()
+			sessionObj.unstamped = true
+		} else if time.Since(sessionObj.created) > s.AbsoluteLifetime {
+			if err = s.Storer.Del(r.Context(), key); err != nil {
+				return nil, errors.Wrap(err, "failed to delete expired session")
+			}
+			return nil, errNoSession{}
+		}
+	}
+
+	return sessionObj, nil
+}
+
+// codec returns the Codec sessions are written with
+func (s StorageOverseer) codec() Codec {
+	if s.Codec == nil {
+		return JSONCodec{}
+	}
+
+	return s.Codec
+}
+
+// codecs returns the codecs sessions may have been written with besides the
+// built in ones
+func (s StorageOverseer) codecs() []Codec {
+	return append([]Codec{s.Codec}, s.Codecs...)
+}
+
+// get the stored session, along with its version if the Storer is a CASStorer
+func (s StorageOverseer) get(ctx context.Context, key string) (value, version string, err error) {
+	if cas, ok := s.Storer.(CASStorer); ok {
+		return cas.GetVersion(ctx, key)
+	}
+
+	value, err = s.Storer.Get(ctx, key)
+	return value, "", err
+}
+
+// LockKey returns the Storer key of the request's session, see LockKeyer
+func (s StorageOverseer) LockKey(r *http.Request) (string, bool) {
+	value, err := s.options.getCookieValue(r)
+	if err != nil {
+		return "", false
+	}
+
+	id, _, ok := s.verifyID(value)
+	if !ok || !s.IDGenerator.Validate(id) {
+		return "", false
+	}
+
+	return s.storageKey(id), true
+}
+
+// storageKey returns the key the session is kept under in the Storer
+func (s StorageOverseer) storageKey(id string) string {
+	if len(s.HashKey) == 0 {
+		return id
+	}
+
+	return hex.EncodeToString(signature(s.HashKey, id))
 }
 
-func applyEvents(sessionObj session, evs []Event) (doRefresh bool) {
+// signID appends the signature of the id made with the first signing key
+// in the form: id.signature
+func (s StorageOverseer) signID(id string) string {
+	if len(s.SigningKeys) == 0 {
+		return id
+	}
+
+	return id + "." + base64.RawURLEncoding.EncodeToString(signature(s.SigningKeys[0], id))
+}
+
+// verifyID splits the cookie value into the id and its signature and checks
+// the signature against every signing key. stale is true when the signature
+// was not made with the first key.
+func (s StorageOverseer) verifyID(value string) (id string, stale bool, ok bool) {
+	if len(s.SigningKeys) == 0 {
+		return value, false, true
+	}
+
+	dot := strings.LastIndexByte(value, '.')
+	if dot < 0 {
+		return "", false, false
+	}
+
+	id = value[:dot]
+	sig, err := base64.RawURLEncoding.DecodeString(value[dot+1:])
+	if err != nil {
+		return "", false, false
+	}
+
+	for i, key := range s.SigningKeys {
+		if hmac.Equal(sig, signature(key, id)) {
+			return id, i != 0, true
+		}
+	}
+
+	return "", false, false
+}
+
+// signature of the id using HMAC-SHA256
+func signature(key []byte, id string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id))
+	return mac.Sum(nil)
+}
+
+// applyEvents applies the events to the session values. doRefresh is true
+// when a refresh was requested and dirty is true when the values changed.
+func applyEvents(sessionObj session, evs []Event) (doRefresh, dirty bool) {
 	for _, ev := range evs {
 		switch ev.Kind {
 		case EventSet:
-			sessionObj.Values[ev.Key] = ev.Val
+			val := ev.Raw
+			if val == nil {
+				val = rawString(ev.Val)
+			}
+			if old, ok := sessionObj.Values[ev.Key]; !ok || !bytes.Equal(old, val) {
+				sessionObj.Values[ev.Key] = val
+				dirty = true
+			}
 		case EventDel:
-			delete(sessionObj.Values, ev.Key)
+			if _, ok := sessionObj.Values[ev.Key]; ok {
+				delete(sessionObj.Values, ev.Key)
+				dirty = true
+			}
 		case EventDelAll:
 			for k := range sessionObj.Values {
 				whitelisted := false
@@ -79,13 +252,25 @@ func applyEvents(sessionObj session, evs []Event) (doRefresh bool) {
 				}
 
 				delete(sessionObj.Values, k)
+				dirty = true
 			}
 		case EventRefresh:
 			doRefresh = true
 		}
 	}
 
-	return doRefresh
+	return doRefresh, dirty
+}
+
+// hasEvent returns true if evs contains an event of the given kind
+func hasEvent(evs []Event, kind EventKind) bool {
+	for _, ev := range evs {
+		if ev.Kind == kind {
+			return true
+		}
+	}
+
+	return false
 }
 
 // WriteState to the response
@@ -101,39 +286,216 @@ func (s StorageOverseer) WriteState(ctx context.Context, w http.ResponseWriter,
 		sessionObj = sess.(session)
 	} else {
 		isNew = true
-		uuidID, err := uuid.NewV4()
-		if err != nil {
-			return errors.Wrap(err, "failed to create uuid for session")
+		sessionObj = session{
+			Values: make(map[string]json.RawMessage),
 		}
+	}
 
-		sessionObj = session{
-			ID:     uuidID.String(),
-			Values: make(map[string]string),
+	doRefresh, dirty := applyEvents(sessionObj, evs)
+	doRefresh = doRefresh && !isNew
+	regenerate := hasEvent(evs, EventRegenerate) && !isNew
+
+	ttlChanged := false
+	if ttl, ok := eventTTL(evs); ok && ttl != sessionObj.ttl {
+		sessionObj.ttl = ttl
+		ttlChanged = true
+	}
+
+	// Anonymous visitors only get a session once something is stored in it,
+	// but a cookie we could not read should still go away.
+	if isNew && !dirty {
+		if hasEvent(evs, EventDelClientState) {
+			s.options.deleteCookie(w)
 		}
+		return nil
 	}
 
-	doRefresh := applyEvents(sessionObj, evs) && !isNew
+	oldID := sessionObj.ID
+	if isNew || regenerate {
+		id, err := s.IDGenerator.Generate()
+		if err != nil {
+			return err
+		}
+		sessionObj.ID = id
 
-	encodedValues, err := json.Marshal(sessionObj.Values)
-	if err != nil {
-		return errors.Wrap(err, "failed to marshal session values to json")
+		if s.AbsoluteLifetime != 0 {
+			sessionObj.created = time.Now()
+		}
 	}
 
-	err = s.Storer.Set(ctx, sessionObj.ID, string(encodedValues))
-	if err != nil {
-		return errors.Wrap(err, "failed to store session values")
+	// Refreshing only resets the expiry unless the time of the refresh is
+	// tracked for a throttled RefreshMiddleware
+	trackRefresh := false
+	if at := eventRefreshed(evs); !at.IsZero() && (doRefresh || isNew) {
+		sessionObj.refreshed = at
+		trackRefresh = doRefresh
+	}
+
+	refreshed := false
+	if dirty || trackRefresh || regenerate || ttlChanged || sessionObj.unhashed || sessionObj.unstamped {
+		overwrite := isNew || regenerate || sessionObj.unhashed
+		var err error
+		if refreshed, err = s.store(ctx, sessionObj, evs, overwrite, doRefresh); err != nil {
+			return err
+		}
 	}
 
-	if doRefresh {
-		if err = s.Storer.ResetExpiry(ctx, sessionObj.ID); err != nil {
+	if doRefresh && !refreshed {
+		err := s.resetExpiry(ctx, s.storageKey(sessionObj.ID), sessionObj.ttl)
+		if IsNoSessionError(err) {
+			// The session expired or was deleted since it was read, the
+			// cookie points at nothing now
+			s.options.deleteCookie(w)
+			return nil
+		} else if err != nil {
 			return errors.Wrap(err, "failed to refresh session")
 		}
 	}
 
-	if isNew || doRefresh {
-		cookie := s.options.makeCookie(sessionObj.ID)
-		http.SetCookie(w, cookie)
+	if sessionObj.unhashed {
+		if err := s.Storer.Del(ctx, oldID); err != nil {
+			return errors.Wrap(err, "failed to delete unhashed session")
+		}
+	} else if regenerate {
+		if err := s.Storer.Del(ctx, s.storageKey(oldID)); err != nil {
+			return errors.Wrap(err, "failed to delete regenerated session")
+		}
+	}
+
+	if isNew || doRefresh || regenerate || ttlChanged || sessionObj.stale {
+		opts := s.options
+		if sessionObj.ttl != 0 {
+			opts.MaxAge = sessionObj.ttl
+		}
+		http.SetCookie(w, opts.makeCookie(s.signID(sessionObj.ID)))
 	}
 
 	return nil
 }
+
+// eventTTL returns the TTL of the last EventSetTTL in evs
+func eventTTL(evs []Event) (ttl time.Duration, ok bool) {
+	for _, ev := range evs {
+		if ev.Kind == EventSetTTL {
+			ttl, ok = ev.TTL, true
+		}
+	}
+
+	return ttl, ok
+}
+
+// eventRefreshed returns the latest Refreshed time of the EventRefreshes in
+// evs
+func eventRefreshed(evs []Event) (refreshed time.Time) {
+	for _, ev := range evs {
+		if ev.Kind == EventRefresh && ev.Refreshed.After(refreshed) {
+			refreshed = ev.Refreshed
+		}
+	}
+
+	return refreshed
+}
+
+// set stores the value, with the ttl if there is one and the Storer is a
+// TTLStorer
+func (s StorageOverseer) set(ctx context.Context, key, value string, ttl time.Duration) error {
+	if ttlStorer, ok := s.Storer.(TTLStorer); ok && ttl != 0 {
+		return ttlStorer.SetWithTTL(ctx, key, value, ttl)
+	}
+
+	return s.Storer.Set(ctx, key, value)
+}
+
+// resetExpiry resets the expiry of the key, to the ttl if there is one and
+// the Storer is a TTLStorer
+func (s StorageOverseer) resetExpiry(ctx context.Context, key string, ttl time.Duration) error {
+	if ttlStorer, ok := s.Storer.(TTLStorer); ok && ttl != 0 {
+		return ttlStorer.ResetExpiryTTL(ctx, key, ttl)
+	}
+
+	return s.Storer.ResetExpiry(ctx, key)
+}
+
+// store the session values. When the Storer is a CASStorer the values are
+// only stored if nobody else changed the session since it was read, if they
+// did the session is read again and the events are replayed on top of it.
+// overwrite skips the comparison for sessions under an ID nobody else knows.
+// When refresh is set and the Storer can reset the expiry while storing
+// (a RefreshStorer or CASRefreshStorer) it does so. It returns whether the
+// expiry of the stored session was reset.
+func (s StorageOverseer) store(ctx context.Context, sessionObj session, evs []Event, overwrite, refresh bool) (bool, error) {
+	key := s.storageKey(sessionObj.ID)
+	cas, ok := s.Storer.(CASStorer)
+
+	for i := 0; ; i++ {
+		encodedSession, err := encodeRecord(sessionObj, s.codec())
+		if err != nil {
+			return false, err
+		}
+		if encodedSession, err = compress(encodedSession, s.CompressThreshold); err != nil {
+			return false, err
+		}
+
+		if !ok || overwrite {
+			if refreshStorer, ok := s.Storer.(RefreshStorer); ok && refresh {
+				err = refreshStorer.SetAndRefresh(ctx, key, encodedSession, sessionObj.ttl)
+				return err == nil, errors.Wrap(err, "failed to store session values")
+			}
+
+			err = s.set(ctx, key, encodedSession, sessionObj.ttl)
+			if err != nil {
+				return false, errors.Wrap(err, "failed to store session values")
+			}
+			// Storing a session with a ttl resets its expiry
+			return sessionObj.ttl != 0, nil
+		}
+
+		casRefresh, canRefresh := cas.(CASRefreshStorer)
+		if canRefresh && (refresh || sessionObj.ttl != 0) {
+			err = casRefresh.CompareAndSetAndRefresh(ctx, key, encodedSession, sessionObj.version, sessionObj.ttl)
+			if err == nil {
+				return true, nil
+			}
+		} else {
+			err = cas.CompareAndSet(ctx, key, encodedSession, sessionObj.version)
+			if err == nil {
+				// CompareAndSet always uses the Storer's own expiry
+				if sessionObj.ttl != 0 {
+					return true, errors.Wrap(s.resetExpiry(ctx, key, sessionObj.ttl), "failed to set session ttl")
+				}
+				return false, nil
+			}
+		}
+		if !IsVersionConflictError(err) || i == casRetries {
+			return false, errors.Wrap(err, "failed to store session values")
+		}
+
+		encodedSession, version, err := cas.GetVersion(ctx, key)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to read session after version conflict")
+		}
+
+		created, refreshed := sessionObj.created, sessionObj.refreshed
+		if err = decodeRecord(encodedSession, &sessionObj, s.codecs()...); err != nil {
+			return false, errors.Wrap(err, "failed to unmarshal session after version conflict")
+		}
+		if sessionObj.created.IsZero() {
+			sessionObj.created = created
+		}
+		sessionObj.version = version
+
+		// The concurrent change may already have done what we wanted to do
+		_, dirty := applyEvents(sessionObj, evs)
+		if ttl, ok := eventTTL(evs); ok && ttl != sessionObj.ttl {
+			sessionObj.ttl = ttl
+			dirty = true
+		}
+		if refreshed.After(sessionObj.refreshed) {
+			sessionObj.refreshed = refreshed
+			dirty = true
+		}
+		if !dirty {
+			return false, nil
+		}
+	}
+}
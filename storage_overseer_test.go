@@ -1,10 +1,14 @@
 package possessions
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
 	"testing"
+	"time"
 )
 
 var (
@@ -99,7 +103,7 @@ func TestWriteState(t *testing.T) {
 
 	ev := Event{Kind: EventSet, Key: "key", Val: "value"}
 
-	sess := session{ID: uuid, Values: map[string]string{}}
+	sess := session{ID: uuid, Values: map[string]json.RawMessage{}}
 	s.WriteState(ctx, w, sess, []Event{ev})
 	val, err := m.Get(r.Context(), uuid)
 	if err != nil {
@@ -110,6 +114,7 @@ func TestWriteState(t *testing.T) {
 		t.Error("invalid value in memory storer session")
 	}
 
+	w.events = []Event{ev}
 	w.WriteHeader(http.StatusOK)
 	if rec.Header().Get("Set-Cookie") == "" {
 		t.Error("cookie value not set")
@@ -120,7 +125,7 @@ func TestApplyEvents(t *testing.T) {
 	t.Parallel()
 
 	uuid := "816a1acb-73aa-4a75-bbeb-f371bdad40e8"
-	sess := session{ID: uuid, Values: map[string]string{}}
+	sess := session{ID: uuid, Values: map[string]json.RawMessage{}}
 
 	events := []Event{
 		{Kind: EventSet, Key: "key1", Val: "value1"},
@@ -132,10 +137,13 @@ func TestApplyEvents(t *testing.T) {
 		{Kind: EventRefresh},
 	}
 
-	doRefresh := applyEvents(sess, events)
+	doRefresh, dirty := applyEvents(sess, events)
 	if !doRefresh {
 		t.Error("expected do refresh to be true")
 	}
+	if !dirty {
+		t.Error("expected dirty to be true")
+	}
 
 	if len(sess.Values) != 2 {
 		t.Error("expected only 2 keys to be set")
@@ -148,3 +156,873 @@ func TestApplyEvents(t *testing.T) {
 		t.Error("cant find key3")
 	}
 }
+
+// countingStorer wraps a storer and counts the calls made to it
+type countingStorer struct {
+	Storer
+	gets    int
+	sets    int
+	refresh int
+}
+
+func (c *countingStorer) Get(ctx context.Context, key string) (string, error) {
+	c.gets++
+	return c.Storer.Get(ctx, key)
+}
+
+func (c *countingStorer) Set(ctx context.Context, key, value string) error {
+	c.sets++
+	return c.Storer.Set(ctx, key, value)
+}
+
+func (c *countingStorer) ResetExpiry(ctx context.Context, key string) error {
+	c.refresh++
+	return c.Storer.ResetExpiry(ctx, key)
+}
+
+func TestApplyEventsNotDirty(t *testing.T) {
+	t.Parallel()
+
+	sess := session{Values: map[string]json.RawMessage{"key1": rawString("value1")}}
+
+	events := []Event{
+		{Kind: EventSet, Key: "key1", Val: "value1"},
+		{Kind: EventDel, Key: "key2"},
+		{Kind: EventDelAll, Keys: []string{"key1"}},
+	}
+
+	doRefresh, dirty := applyEvents(sess, events)
+	if doRefresh {
+		t.Error("expected do refresh to be false")
+	}
+	if dirty {
+		t.Error("expected dirty to be false")
+	}
+}
+
+func TestWriteStateDirtyTracking(t *testing.T) {
+	t.Parallel()
+
+	uuid := "816a1acb-73aa-4a75-bbeb-f371bdad40e8"
+	ctx := context.Background()
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Set(ctx, uuid, `{"key":"value"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Name      string
+		Session   Session
+		Events    []Event
+		Sets      int
+		Refreshes int
+		Cookie    bool
+	}{
+		{Name: "AnonymousNoEvents"},
+		{Name: "AnonymousRefresh", Events: []Event{{Kind: EventRefresh}}},
+		{Name: "AnonymousDel", Events: []Event{{Kind: EventDel, Key: "key"}}},
+		{
+			Name:   "AnonymousSet",
+			Events: []Event{{Kind: EventSet, Key: "key", Val: "value"}},
+			Sets:   1,
+			Cookie: true,
+		},
+		{
+			Name:    "ExistingNoEvents",
+			Session: session{ID: uuid, Values: map[string]json.RawMessage{"key": rawString("value")}},
+		},
+		{
+			Name:    "ExistingSameValue",
+			Session: session{ID: uuid, Values: map[string]json.RawMessage{"key": rawString("value")}},
+			Events:  []Event{{Kind: EventSet, Key: "key", Val: "value"}},
+		},
+		{
+			Name:      "ExistingRefresh",
+			Session:   session{ID: uuid, Values: map[string]json.RawMessage{"key": rawString("value")}},
+			Events:    []Event{{Kind: EventRefresh}},
+			Refreshes: 1,
+			Cookie:    true,
+		},
+		{
+			Name:    "ExistingSet",
+			Session: session{ID: uuid, Values: map[string]json.RawMessage{"key": rawString("value")}},
+			Events:  []Event{{Kind: EventSet, Key: "key", Val: "value2"}},
+			Sets:    1,
+		},
+	}
+
+	for _, test := range tests {
+		storer := &countingStorer{Storer: m}
+		s := NewStorageOverseer(NewCookieOptions(), storer)
+		rec := httptest.NewRecorder()
+
+		if err := s.WriteState(ctx, rec, test.Session, test.Events); err != nil {
+			t.Errorf("%s: %v", test.Name, err)
+			continue
+		}
+
+		if storer.sets != test.Sets {
+			t.Errorf("%s: expected %d sets, got %d", test.Name, test.Sets, storer.sets)
+		}
+		if storer.refresh != test.Refreshes {
+			t.Errorf("%s: expected %d refreshes, got %d", test.Name, test.Refreshes, storer.refresh)
+		}
+		if hasCookie := rec.Header().Get("Set-Cookie") != ""; hasCookie != test.Cookie {
+			t.Errorf("%s: expected cookie to be written: %t", test.Name, test.Cookie)
+		}
+	}
+}
+
+func TestWriteStateAnonymousDelClientState(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStorageOverseer(NewCookieOptions(), m)
+	rec := httptest.NewRecorder()
+
+	err = s.WriteState(context.Background(), rec, nil, []Event{{Kind: EventDelClientState}, {Kind: EventRefresh}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge != -1 {
+		t.Errorf("expected the unreadable cookie to be deleted, got: %#v", cookies)
+	}
+	if keys, _ := m.All(context.Background()); len(keys) != 0 {
+		t.Errorf("expected no session to be created, got %d", len(keys))
+	}
+}
+
+func TestWriteStateRegenerate(t *testing.T) {
+	t.Parallel()
+
+	uuid := "816a1acb-73aa-4a75-bbeb-f371bdad40e8"
+	ctx := context.Background()
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Set(ctx, uuid, `{"key":"value"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStorageOverseer(NewCookieOptions(), m)
+	rec := httptest.NewRecorder()
+
+	sess := session{ID: uuid, Values: map[string]json.RawMessage{"key": rawString("value")}}
+	err = s.WriteState(ctx, rec, sess, []Event{{Kind: EventRegenerate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = m.Get(ctx, uuid); !IsNoSessionError(err) {
+		t.Errorf("expected the old session to be deleted, got: %v", err)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie, got %d", len(cookies))
+	}
+	if cookies[0].Value == uuid || !validKey(cookies[0].Value) {
+		t.Errorf("expected a new session id, got: %q", cookies[0].Value)
+	}
+
+	val, err := m.Get(ctx, cookies[0].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != `{"key":"value"}` {
+		t.Errorf("expected values to be copied to the new session, got: %s", val)
+	}
+}
+
+func TestStorageOverseerIDGenerator(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStorageOverseer(NewCookieOptions(), m)
+	s.IDGenerator = RandomIDGenerator{Size: 32}
+
+	rec := httptest.NewRecorder()
+	err = s.WriteState(ctx, rec, nil, []Event{{Kind: EventSet, Key: "key", Val: "value"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie, got %d", len(cookies))
+	}
+	if !s.IDGenerator.Validate(cookies[0].Value) || validKey(cookies[0].Value) {
+		t.Errorf("expected a random id, got: %q", cookies[0].Value)
+	}
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(cookies[0])
+	sess, err := s.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := sess.Get("key"); !ok || val != "value" {
+		t.Errorf("expected key to be value, got: %q", val)
+	}
+
+	// A uuid is no longer a valid id
+	r = httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: "816a1acb-73aa-4a75-bbeb-f371bdad40e8"})
+	if _, err = s.ReadState(r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+}
+
+func TestStorageOverseerSigningKeys(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	uuid := "816a1acb-73aa-4a75-bbeb-f371bdad40e8"
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Set(ctx, uuid, `{"key":"value"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	storer := &countingStorer{Storer: m}
+	oldKey, newKey := []byte("old signing key"), []byte("new signing key")
+
+	s := NewStorageOverseer(NewCookieOptions(), storer)
+	s.SigningKeys = [][]byte{newKey, oldKey}
+
+	old := NewStorageOverseer(NewCookieOptions(), m)
+	old.SigningKeys = [][]byte{oldKey}
+
+	forged := []string{
+		uuid,
+		uuid + ".",
+		uuid + ".bm90IGEgc2lnbmF0dXJl",
+		"816a1acb-73aa-4a75-bbeb-f371bdad40e9" + old.signID(uuid)[len(uuid):],
+	}
+	for _, value := range forged {
+		r := httptest.NewRequest("GET", "http://localhost", nil)
+		r.AddCookie(&http.Cookie{Name: "id", Value: value})
+		if _, err := s.ReadState(r); !IsNoSessionError(err) {
+			t.Errorf("expected %q to be rejected, got: %v", value, err)
+		}
+	}
+	if storer.gets != 0 {
+		t.Errorf("expected forged ids never to reach the storer, got %d gets", storer.gets)
+	}
+
+	// Signed with the current key
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: s.signID(uuid)})
+	sess, err := s.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := sess.Get("key"); !ok || val != "value" {
+		t.Errorf("expected key to be value, got: %q", val)
+	}
+	if sess.(session).stale {
+		t.Error("expected session signed with the first key not to be stale")
+	}
+
+	// Signed with a rotated key is accepted and re-signed
+	r = httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: old.signID(uuid)})
+	sess, err = s.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sess.(session).stale {
+		t.Error("expected session signed with an old key to be stale")
+	}
+
+	rec := httptest.NewRecorder()
+	if err = s.WriteState(ctx, rec, sess, nil); err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != s.signID(uuid) {
+		t.Errorf("expected cookie to be re-signed with the first key, got: %#v", cookies)
+	}
+}
+
+func TestStorageOverseerHashKey(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	uuid := "816a1acb-73aa-4a75-bbeb-f371bdad40e8"
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStorageOverseer(NewCookieOptions(), m)
+	s.HashKey = []byte("hash key")
+
+	// New sessions are stored under the hash of their id
+	rec := httptest.NewRecorder()
+	if err = s.WriteState(ctx, rec, nil, []Event{{Kind: EventSet, Key: "key", Val: "value"}}); err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie, got %d", len(cookies))
+	}
+	keys, _ := m.All(ctx)
+	if len(keys) != 1 || keys[0] != s.storageKey(cookies[0].Value) || keys[0] == cookies[0].Value {
+		t.Errorf("expected session to be stored under the hashed id, got: %v", keys)
+	}
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(cookies[0])
+	sess, err := s.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := sess.Get("key"); !ok || val != "value" {
+		t.Errorf("expected key to be value, got: %q", val)
+	}
+
+	// Unhashed sessions are only found when migrating
+	if err = m.Set(ctx, uuid, `{"key":"legacy"}`); err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: uuid})
+	if _, err = s.ReadState(r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+
+	s.MigrateUnhashedKeys = true
+	sess, err = s.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := sess.Get("key"); !ok || val != "legacy" {
+		t.Errorf("expected key to be legacy, got: %q", val)
+	}
+
+	rec = httptest.NewRecorder()
+	if err = s.WriteState(ctx, rec, sess, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Header().Get("Set-Cookie") != "" {
+		t.Error("expected the cookie to be left alone")
+	}
+	if _, err = m.Get(ctx, uuid); !IsNoSessionError(err) {
+		t.Errorf("expected the unhashed session to be deleted, got: %v", err)
+	}
+	if val, err := m.Get(ctx, s.storageKey(uuid)); err != nil || val != `{"key":"legacy"}` {
+		t.Errorf("expected the session to be moved under the hashed id, got: %q %v", val, err)
+	}
+
+	sess, err = s.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.(session).unhashed {
+		t.Error("expected the migrated session to be found under the hashed id")
+	}
+}
+
+func TestWriteStateVersionConflict(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	uuid := "816a1acb-73aa-4a75-bbeb-f371bdad40e8"
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Set(ctx, uuid, `{"a":"1"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStorageOverseer(NewCookieOptions(), m)
+
+	// Two requests read the session before either writes it
+	read := func() Session {
+		r := httptest.NewRequest("GET", "http://localhost", nil)
+		r.AddCookie(&http.Cookie{Name: "id", Value: uuid})
+		sess, err := s.ReadState(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sess
+	}
+	first, second := read(), read()
+
+	err = s.WriteState(ctx, httptest.NewRecorder(), first, []Event{{Kind: EventSet, Key: "b", Val: "2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.WriteState(ctx, httptest.NewRecorder(), second, []Event{
+		{Kind: EventSet, Key: "c", Val: "3"},
+		{Kind: EventDel, Key: "a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := m.Get(ctx, uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != `{"b":"2","c":"3"}` {
+		t.Errorf("expected both writes to be kept, got: %s", val)
+	}
+
+	// A session deleted in the mean time is not brought back
+	third := read()
+	if err = m.Del(ctx, uuid); err != nil {
+		t.Fatal(err)
+	}
+	err = s.WriteState(ctx, httptest.NewRecorder(), third, []Event{{Kind: EventSet, Key: "d", Val: "4"}})
+	if !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+	if _, err = m.Get(ctx, uuid); !IsNoSessionError(err) {
+		t.Errorf("expected session to stay deleted, got: %v", err)
+	}
+}
+
+func TestStorageOverseerAbsoluteLifetime(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	uuid := "816a1acb-73aa-4a75-bbeb-f371bdad40e8"
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStorageOverseer(NewCookieOptions(), m)
+	s.AbsoluteLifetime = time.Hour
+
+	read := func() (Session, error) {
+		r := httptest.NewRequest("GET", "http://localhost", nil)
+		r.AddCookie(&http.Cookie{Name: "id", Value: uuid})
+		return s.ReadState(r)
+	}
+
+	// Sessions stored before the lifetime was set are stamped when read
+	if err = m.Set(ctx, uuid, `{"key":"value"}`); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.WriteState(ctx, httptest.NewRecorder(), sess, nil); err != nil {
+		t.Fatal(err)
+	}
+	sess, err = read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created := sess.(session).created; time.Since(created) > time.Minute {
+		t.Errorf("expected session to be stamped with the current time, got: %v", created)
+	}
+	if val, ok := sess.Get("key"); !ok || val != "value" {
+		t.Errorf("expected key to be value, got: %q", val)
+	}
+
+	// Expired sessions are deleted
+	created := time.Now().Add(-2 * time.Hour).Unix()
+	if err = m.Set(ctx, uuid, fmt.Sprintf(`r{"created":%d,"values":{"key":"value"}}`, created)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = read(); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+	if _, err = m.Get(ctx, uuid); !IsNoSessionError(err) {
+		t.Errorf("expected expired session to be deleted, got: %v", err)
+	}
+
+	// Regenerating starts a new lifetime
+	created = time.Now().Add(-50 * time.Minute).Unix()
+	if err = m.Set(ctx, uuid, fmt.Sprintf(`r{"created":%d,"values":{"key":"value"}}`, created)); err != nil {
+		t.Fatal(err)
+	}
+	sess, err = read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	if err = s.WriteState(ctx, rec, sess, []Event{{Kind: EventRegenerate}}); err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie, got %d", len(cookies))
+	}
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(cookies[0])
+	sess, err = s.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(sess.(session).created) > time.Minute {
+		t.Errorf("expected regenerated session to have a new creation time, got: %v", sess.(session).created)
+	}
+}
+
+func TestOverseeingMiddlewareAbsoluteLifetime(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	uuid := "816a1acb-73aa-4a75-bbeb-f371bdad40e8"
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Now().Add(-2 * time.Hour).Unix()
+	if err = m.Set(ctx, uuid, fmt.Sprintf(`r{"created":%d,"values":{}}`, created)); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStorageOverseer(NewCookieOptions(), m)
+	s.AbsoluteLifetime = time.Hour
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: uuid})
+	rec := httptest.NewRecorder()
+	NewOverseeingMiddleware(s).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, r)
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("expected the cookie to be deleted, got: %#v", cookies)
+	}
+}
+
+// ttlStorer records the ttls the StorageOverseer uses
+type ttlStorer struct {
+	*MemoryStorer
+	ttls []time.Duration
+}
+
+func (t *ttlStorer) SetWithTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+	t.ttls = append(t.ttls, ttl)
+	return t.MemoryStorer.SetWithTTL(ctx, key, value, ttl)
+}
+
+func (t *ttlStorer) ResetExpiryTTL(ctx context.Context, key string, ttl time.Duration) error {
+	t.ttls = append(t.ttls, ttl)
+	return t.MemoryStorer.ResetExpiryTTL(ctx, key, ttl)
+}
+
+func TestStorageOverseerTTL(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storer := &ttlStorer{MemoryStorer: m}
+
+	opts := NewCookieOptions()
+	opts.MaxAge = 2 * time.Hour
+	s := NewStorageOverseer(opts, storer)
+
+	// Sessions without a ttl use the defaults
+	rec := httptest.NewRecorder()
+	if err = s.WriteState(ctx, rec, nil, []Event{{Kind: EventSet, Key: "key", Val: "value"}}); err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge != 7200 {
+		t.Fatalf("expected a cookie with the default max age, got: %#v", cookies)
+	}
+	if len(storer.ttls) != 0 {
+		t.Errorf("expected no ttls to be used, got: %v", storer.ttls)
+	}
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(cookies[0])
+	sess, err := s.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Remember me
+	month := 30 * 24 * time.Hour
+	rec = httptest.NewRecorder()
+	if err = s.WriteState(ctx, rec, sess, []Event{{Kind: EventSetTTL, TTL: month}}); err != nil {
+		t.Fatal(err)
+	}
+	cookies = rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge != int(month.Seconds()) {
+		t.Fatalf("expected a cookie with a max age of a month, got: %#v", cookies)
+	}
+	if len(storer.ttls) != 1 || storer.ttls[0] != month {
+		t.Errorf("expected the session to be stored with a ttl of a month, got: %v", storer.ttls)
+	}
+
+	// The ttl is kept for refreshes
+	r = httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(cookies[0])
+	sess, err = s.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := sess.Get("key"); !ok || val != "value" {
+		t.Errorf("expected key to be value, got: %q", val)
+	}
+
+	rec = httptest.NewRecorder()
+	if err = s.WriteState(ctx, rec, sess, []Event{{Kind: EventRefresh}}); err != nil {
+		t.Fatal(err)
+	}
+	cookies = rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].MaxAge != int(month.Seconds()) {
+		t.Fatalf("expected a cookie with a max age of a month, got: %#v", cookies)
+	}
+	if len(storer.ttls) != 2 || storer.ttls[1] != month {
+		t.Errorf("expected the refresh to use a ttl of a month, got: %v", storer.ttls)
+	}
+}
+
+func TestWriteStateRefreshed(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	uuid := "816a1acb-73aa-4a75-bbeb-f371bdad40e8"
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Set(ctx, uuid, `{"key":"value"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStorageOverseer(NewCookieOptions(), m)
+
+	read := func() Session {
+		r := httptest.NewRequest("GET", "http://localhost", nil)
+		r.AddCookie(&http.Cookie{Name: "id", Value: uuid})
+		sess, err := s.ReadState(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sess
+	}
+
+	sess := read()
+	if !sess.(session).refreshed.IsZero() {
+		t.Error("expected session not to have been refreshed")
+	}
+
+	// Plain refreshes only reset the expiry
+	if err = s.WriteState(ctx, httptest.NewRecorder(), sess, []Event{{Kind: EventRefresh}}); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := m.Get(ctx, uuid); stored != `{"key":"value"}` {
+		t.Errorf("expected the session not to be rewritten, got: %s", stored)
+	}
+
+	refreshedAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	if err = s.WriteState(ctx, httptest.NewRecorder(), sess, []Event{{Kind: EventRefresh, Refreshed: refreshedAt}}); err != nil {
+		t.Fatal(err)
+	}
+
+	sess = read()
+	if refreshed := sess.(session).refreshed; !refreshed.Equal(refreshedAt) {
+		t.Errorf("expected the refresh time to be stored, got: %v", refreshed)
+	}
+	if val, ok := sess.Get("key"); !ok || val != "value" {
+		t.Errorf("expected key to be value, got: %q", val)
+	}
+}
+
+// refreshStorer is a RefreshStorer that counts the calls the
+// StorageOverseer makes to it
+type refreshStorer struct {
+	Storer
+	setAndRefreshes int
+	sets            int
+	refreshes       int
+}
+
+func (r *refreshStorer) SetAndRefresh(ctx context.Context, key, value string, ttl time.Duration) error {
+	r.setAndRefreshes++
+	return r.Storer.Set(ctx, key, value)
+}
+
+func (r *refreshStorer) Set(ctx context.Context, key, value string) error {
+	r.sets++
+	return r.Storer.Set(ctx, key, value)
+}
+
+func (r *refreshStorer) ResetExpiry(ctx context.Context, key string) error {
+	r.refreshes++
+	return r.Storer.ResetExpiry(ctx, key)
+}
+
+// casRefreshStorer is a CASRefreshStorer that counts the calls the
+// StorageOverseer makes to it
+type casRefreshStorer struct {
+	*MemoryStorer
+	casAndRefreshes int
+	cas             int
+	refreshes       int
+}
+
+func (c *casRefreshStorer) CompareAndSetAndRefresh(ctx context.Context, key, value, version string, ttl time.Duration) error {
+	c.casAndRefreshes++
+	if ttl == 0 {
+		ttl = c.maxAge
+	}
+	if err := c.MemoryStorer.CompareAndSet(ctx, key, value, version); err != nil {
+		return err
+	}
+	return c.MemoryStorer.ResetExpiryTTL(ctx, key, ttl)
+}
+
+func (c *casRefreshStorer) CompareAndSet(ctx context.Context, key, value, version string) error {
+	c.cas++
+	return c.MemoryStorer.CompareAndSet(ctx, key, value, version)
+}
+
+func (c *casRefreshStorer) ResetExpiry(ctx context.Context, key string) error {
+	c.refreshes++
+	return c.MemoryStorer.ResetExpiry(ctx, key)
+}
+
+func (c *casRefreshStorer) ResetExpiryTTL(ctx context.Context, key string, ttl time.Duration) error {
+	c.refreshes++
+	return c.MemoryStorer.ResetExpiryTTL(ctx, key, ttl)
+}
+
+func TestWriteStateRefreshDeleted(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	uuid := "816a1acb-73aa-4a75-bbeb-f371bdad40e8"
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Set(ctx, uuid, `{"key":"value"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStorageOverseer(NewCookieOptions(), m)
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: uuid})
+	sess, err := s.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The session expires or is logged out elsewhere before the refresh
+	if err = m.Del(ctx, uuid); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	if err = s.WriteState(ctx, w, sess, []Event{{Kind: EventRefresh}}); err != nil {
+		t.Fatalf("expected refreshing a deleted session not to fail, got: %v", err)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "id" || cookies[0].MaxAge >= 0 {
+		t.Errorf("expected the cookie to be deleted, got: %v", cookies)
+	}
+	if _, err = m.Get(ctx, uuid); !IsNoSessionError(err) {
+		t.Errorf("expected the session to stay deleted, got: %v", err)
+	}
+}
+
+func TestWriteStateSetAndRefresh(t *testing.T) {
+	t.Parallel()
+
+	uuid := "816a1acb-73aa-4a75-bbeb-f371bdad40e8"
+	ctx := context.Background()
+	sess := session{ID: uuid, Values: map[string]json.RawMessage{"key": rawString("value")}}
+
+	m, err := NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Set(ctx, uuid, `{"key":"value"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	storer := &refreshStorer{Storer: m}
+	s := NewStorageOverseer(NewCookieOptions(), storer)
+
+	// A plain refresh only resets the expiry
+	if err = s.WriteState(ctx, httptest.NewRecorder(), sess, []Event{{Kind: EventRefresh}}); err != nil {
+		t.Fatal(err)
+	}
+	if storer.setAndRefreshes != 0 || storer.sets != 0 || storer.refreshes != 1 {
+		t.Errorf("expected a single ResetExpiry, got: %d set and refreshes, %d sets, %d refreshes",
+			storer.setAndRefreshes, storer.sets, storer.refreshes)
+	}
+	storer.refreshes = 0
+
+	refreshAndSet := []Event{{Kind: EventRefresh}, {Kind: EventSet, Key: "key", Val: "value3"}}
+	if err = s.WriteState(ctx, httptest.NewRecorder(), sess, refreshAndSet); err != nil {
+		t.Fatal(err)
+	}
+	if storer.setAndRefreshes != 1 || storer.sets != 0 || storer.refreshes != 0 {
+		t.Errorf("expected a single SetAndRefresh, got: %d set and refreshes, %d sets, %d refreshes",
+			storer.setAndRefreshes, storer.sets, storer.refreshes)
+	}
+
+	// Writes that do not refresh keep using Set
+	if err = s.WriteState(ctx, httptest.NewRecorder(), sess, []Event{{Kind: EventSet, Key: "key", Val: "value2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if storer.setAndRefreshes != 1 || storer.sets != 1 {
+		t.Errorf("expected a Set, got: %d set and refreshes, %d sets", storer.setAndRefreshes, storer.sets)
+	}
+
+	casStorer := &casRefreshStorer{MemoryStorer: m}
+	s = NewStorageOverseer(NewCookieOptions(), casStorer)
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: uuid})
+	read, err := s.ReadState(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.WriteState(ctx, httptest.NewRecorder(), read, refreshAndSet); err != nil {
+		t.Fatal(err)
+	}
+	if casStorer.casAndRefreshes != 1 || casStorer.cas != 0 || casStorer.refreshes != 0 {
+		t.Errorf("expected a single CompareAndSetAndRefresh, got: %d cas and refreshes, %d cas, %d refreshes",
+			casStorer.casAndRefreshes, casStorer.cas, casStorer.refreshes)
+	}
+}